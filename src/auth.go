@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+)
+
+// compare two strings in constant time, hashing first so lengths are not leaked
+func secureCompare(a, b string) bool {
+	ha := sha256.Sum256([]byte(a))
+	hb := sha256.Sum256([]byte(b))
+	return subtle.ConstantTimeCompare(ha[:], hb[:]) == 1
+}
+
+// wrap a handler with http basic auth when metrics credentials are configured
+func basicAuth(e *Env, h http.Handler) http.Handler {
+	if e.metricsUser == "" || e.metricsPassword == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		// evaluate both so timing does not reveal which one was wrong
+		userOK := secureCompare(user, e.metricsUser)
+		passwordOK := secureCompare(password, e.metricsPassword)
+		if !ok || !userOK || !passwordOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="metrics"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
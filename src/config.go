@@ -0,0 +1,32 @@
+package main
+
+import (
+	"io/ioutil"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Config ...
+type Config struct {
+	APIKey         string   `yaml:"api_key"`
+	MaintenanceIDs []int    `yaml:"maintenance_ids"`
+	PollInterval   int      `yaml:"poll_interval"`
+	CheckTags      []string `yaml:"check_tags"`
+	WindowFrom     string   `yaml:"window_from"`
+	WindowTo       string   `yaml:"window_to"`
+	Timezone       string   `yaml:"timezone"`
+}
+
+// read the yaml config file, unknown keys are rejected to catch typos
+func loadConfig(path string) (Config, error) {
+	c := Config{}
+	if path == "" {
+		return c, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return c, err
+	}
+	err = yaml.UnmarshalStrict(data, &c)
+	return c, err
+}
@@ -0,0 +1,167 @@
+package main
+
+import "strings"
+
+// tag names of an uptime check
+func (c PingdomCheck) tagNames() []string {
+	names := []string{}
+	for _, t := range c.Tags {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+// true if any of tags is in list
+func hasAnyTag(tags []string, list []string) bool {
+	for _, t := range tags {
+		for _, l := range list {
+			if t == l {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// drop uptime checks tagged with any of the excluded tags
+func excludeTagged(c PingdomChecks, exclude []string) PingdomChecks {
+	if len(exclude) == 0 {
+		return c
+	}
+	checks := []PingdomCheck{}
+	for _, check := range c.Checks {
+		if !hasAnyTag(check.tagNames(), exclude) {
+			checks = append(checks, check)
+		}
+	}
+	c.Checks = checks
+	return c
+}
+
+// drop transaction checks tagged with any of the excluded tags
+func excludeTaggedTms(c PingdomTmsChecks, exclude []string) PingdomTmsChecks {
+	if len(exclude) == 0 {
+		return c
+	}
+	checks := []PingdomTmsCheck{}
+	for _, check := range c.Checks {
+		if !hasAnyTag(check.Tags, exclude) {
+			checks = append(checks, check)
+		}
+	}
+	c.Checks = checks
+	return c
+}
+
+// drop uptime checks with any of the exempt ids, transaction checks have ids
+// of their own and are left to the tag filters
+func excludeIDs(c PingdomChecks, exempt []int) PingdomChecks {
+	if len(exempt) == 0 {
+		return c
+	}
+	checks := []PingdomCheck{}
+	for _, check := range c.Checks {
+		if !containsInt(exempt, check.ID) {
+			checks = append(checks, check)
+		}
+	}
+	c.Checks = checks
+	return c
+}
+
+// true if list contains v
+func containsInt(list []int, v int) bool {
+	for _, l := range list {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
+
+// keep only uptime checks of one of the given types
+func filterTypes(c PingdomChecks, types []string) PingdomChecks {
+	if len(types) == 0 {
+		return c
+	}
+	checks := []PingdomCheck{}
+	for _, check := range c.Checks {
+		if hasAnyTag([]string{check.Type}, types) {
+			checks = append(checks, check)
+		}
+	}
+	c.Checks = checks
+	return c
+}
+
+// keep only uptime checks whose name starts with prefix
+func filterNamePrefix(c PingdomChecks, prefix string) PingdomChecks {
+	if prefix == "" {
+		return c
+	}
+	checks := []PingdomCheck{}
+	for _, check := range c.Checks {
+		if strings.HasPrefix(check.Name, prefix) {
+			checks = append(checks, check)
+		}
+	}
+	c.Checks = checks
+	return c
+}
+
+// keep only uptime checks with a resolution in minutes between min and max,
+// a bound of 0 is left open
+func filterResolution(c PingdomChecks, min int, max int) PingdomChecks {
+	if min == 0 && max == 0 {
+		return c
+	}
+	checks := []PingdomCheck{}
+	for _, check := range c.Checks {
+		if check.Resolution < min || (max != 0 && check.Resolution > max) {
+			continue
+		}
+		checks = append(checks, check)
+	}
+	c.Checks = checks
+	return c
+}
+
+// true if every tag in list is in tags
+func hasAllTags(tags []string, list []string) bool {
+	for _, l := range list {
+		if !hasAnyTag([]string{l}, tags) {
+			return false
+		}
+	}
+	return true
+}
+
+// keep only uptime checks tagged with all of the required tags
+func requireTags(c PingdomChecks, required []string) PingdomChecks {
+	if len(required) == 0 {
+		return c
+	}
+	checks := []PingdomCheck{}
+	for _, check := range c.Checks {
+		if hasAllTags(check.tagNames(), required) {
+			checks = append(checks, check)
+		}
+	}
+	c.Checks = checks
+	return c
+}
+
+// keep only transaction checks tagged with all of the required tags
+func requireTagsTms(c PingdomTmsChecks, required []string) PingdomTmsChecks {
+	if len(required) == 0 {
+		return c
+	}
+	checks := []PingdomTmsCheck{}
+	for _, check := range c.Checks {
+		if hasAllTags(check.Tags, required) {
+			checks = append(checks, check)
+		}
+	}
+	c.Checks = checks
+	return c
+}
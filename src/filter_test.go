@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// uptime checks decoded from a json checks response
+func testChecks(t *testing.T, checks string) PingdomChecks {
+	t.Helper()
+	var c PingdomChecks
+	if err := json.Unmarshal([]byte(`{"checks":`+checks+`}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// ids of the checks in order
+func checkIDs(c PingdomChecks) []int {
+	ids := []int{}
+	for _, check := range c.Checks {
+		ids = append(ids, check.ID)
+	}
+	return ids
+}
+
+func TestFilterNamePrefix(t *testing.T) {
+	c := testChecks(t, `[
+		{"id":1,"name":"prod-api"},
+		{"id":2,"name":"prod-web"},
+		{"id":3,"name":"staging-api"},
+		{"id":4,"name":"Prod-db"},
+		{"id":5,"name":"api prod-"}
+	]`)
+	tests := []struct {
+		prefix string
+		want   []int
+	}{
+		{"", []int{1, 2, 3, 4, 5}},
+		{"prod-", []int{1, 2}},
+		{"prod-api", []int{1}},
+		{"Prod", []int{4}},
+		{"missing", []int{}},
+	}
+	for _, tt := range tests {
+		if got := checkIDs(filterNamePrefix(c, tt.prefix)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("filterNamePrefix(%q) = %v, want %v", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestHasAllTags(t *testing.T) {
+	tests := []struct {
+		tags, list []string
+		want       bool
+	}{
+		{[]string{"sla", "prod"}, []string{"sla", "prod"}, true},
+		{[]string{"prod", "sla", "eu"}, []string{"sla", "prod"}, true},
+		{[]string{"sla"}, []string{"sla", "prod"}, false},
+		{[]string{}, []string{"sla"}, false},
+		{[]string{"sla"}, nil, true},
+	}
+	for _, tt := range tests {
+		if got := hasAllTags(tt.tags, tt.list); got != tt.want {
+			t.Errorf("hasAllTags(%v, %v) = %v, want %v", tt.tags, tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestRequireTags(t *testing.T) {
+	c := testChecks(t, `[
+		{"id":1,"tags":[{"name":"sla"},{"name":"prod"}]},
+		{"id":2,"tags":[{"name":"sla"}]},
+		{"id":3,"tags":[{"name":"prod"},{"name":"sla"},{"name":"eu"}]},
+		{"id":4}
+	]`)
+	if got := checkIDs(requireTags(c, []string{"sla", "prod"})); !reflect.DeepEqual(got, []int{1, 3}) {
+		t.Errorf("requireTags(sla, prod) = %v, want [1 3]", got)
+	}
+	if got := checkIDs(requireTags(c, nil)); !reflect.DeepEqual(got, []int{1, 2, 3, 4}) {
+		t.Errorf("requireTags without tags = %v, want every check", got)
+	}
+
+	tc := PingdomTmsChecks{Checks: []PingdomTmsCheck{
+		{ID: 5, Tags: []string{"sla", "prod"}},
+		{ID: 6, Tags: []string{"sla"}},
+	}}
+	got := requireTagsTms(tc, []string{"sla", "prod"})
+	if len(got.Checks) != 1 || got.Checks[0].ID != 5 {
+		t.Errorf("requireTagsTms(sla, prod) = %v, want only 5", got.Checks)
+	}
+}
+
+func TestFilterResolution(t *testing.T) {
+	c := testChecks(t, `[
+		{"id":1,"resolution":1},
+		{"id":5,"resolution":5},
+		{"id":15,"resolution":15},
+		{"id":60,"resolution":60}
+	]`)
+	tests := []struct {
+		name     string
+		min, max int
+		want     []int
+	}{
+		{"no bounds", 0, 0, []int{1, 5, 15, 60}},
+		{"inclusive min", 5, 0, []int{5, 15, 60}},
+		{"inclusive max", 0, 15, []int{1, 5, 15}},
+		{"inclusive both", 5, 15, []int{5, 15}},
+		{"single value", 15, 15, []int{15}},
+		{"between values", 6, 14, []int{}},
+	}
+	for _, tt := range tests {
+		if got := checkIDs(filterResolution(c, tt.min, tt.max)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: filterResolution(%d, %d) = %v, want %v", tt.name, tt.min, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestExcludeIDs(t *testing.T) {
+	c := testChecks(t, `[{"id":1},{"id":2},{"id":3}]`)
+	if got := checkIDs(excludeIDs(c, []int{2, 9})); !reflect.DeepEqual(got, []int{1, 3}) {
+		t.Errorf("excludeIDs(2, 9) = %v, want [1 3]", got)
+	}
+	if got := checkIDs(excludeIDs(c, nil)); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Errorf("excludeIDs without ids = %v, want every check", got)
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// PollState ...
+type PollState struct {
+	mu                  sync.Mutex
+	lastSuccess         time.Time
+	consecutiveFailures int
+	lastChange          time.Time
+	lastPoll            time.Time
+	uptimeChecks        int
+	tmsChecks           int
+	checks              PingdomChecks
+	tmsCheckList        PingdomTmsChecks
+	schedules           map[int]MaintenanceSchedule
+	updates             int
+}
+
+// counts as changed at startup until a change is seen
+var state = &PollState{lastChange: time.Now(), schedules: map[int]MaintenanceSchedule{}}
+
+// record the outcome of a poll cycle
+func (s *PollState) recordPoll(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastPoll = time.Now()
+	if err != nil {
+		s.consecutiveFailures++
+		return
+	}
+	s.lastSuccess = time.Now()
+	s.consecutiveFailures = 0
+}
+
+// record the checks found in a poll after filtering
+func (s *PollState) recordChecks(c PingdomChecks, tc PingdomTmsChecks) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checks = c
+	s.tmsCheckList = tc
+	s.uptimeChecks = len(getUptimeIds(c))
+	s.tmsChecks = len(getTmsIds(tc))
+}
+
+// CheckList ...
+type CheckList struct {
+	Uptime []PingdomCheck    `json:"uptime"`
+	Tms    []PingdomTmsCheck `json:"tms"`
+}
+
+// checks found in the last poll
+func (s *PollState) checkList() CheckList {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return CheckList{Uptime: s.checks.Checks, Tms: s.tmsCheckList.Checks}
+}
+
+// record a maintenance schedule as last fetched
+func (s *PollState) recordSchedule(m MaintenanceSchedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.schedules[m.ID] = m
+}
+
+// record a change to a maintenance schedule made at t
+func (s *PollState) recordChange(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastChange = t
+}
+
+// record an update to a maintenance schedule made at t
+func (s *PollState) recordUpdate(t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastChange = t
+	s.updates++
+}
+
+// log a heartbeat with the checks found, the checks in the maintenance
+// schedules as last fetched and the updates made since startup
+func (s *PollState) logSummary() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	inMaintenance := 0
+	for _, m := range s.schedules {
+		inMaintenance += len(m.Checks.Uptime)
+	}
+	logInfof("Summary: %d SLA checks, %d in %d maintenance schedules, last change %s, %d updates since startup",
+		s.uptimeChecks, inMaintenance, len(s.schedules), s.lastChange.Format(time.RFC3339), s.updates)
+}
+
+// seconds since the last change to a maintenance schedule
+func (s *PollState) secondsSinceChange() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.lastChange).Seconds()
+}
+
+// ready once a poll has succeeded and we have not failed too many times since
+func (s *PollState) ready(maxFailures int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.lastSuccess.IsZero() && s.consecutiveFailures < maxFailures
+}
+
+// DebugState ...
+type DebugState struct {
+	LastPoll            time.Time                   `json:"last_poll"`
+	LastSuccess         time.Time                   `json:"last_success"`
+	ConsecutiveFailures int                         `json:"consecutive_failures"`
+	UptimeChecks        int                         `json:"uptime_checks"`
+	TmsChecks           int                         `json:"tms_checks"`
+	Schedules           map[int]MaintenanceSchedule `json:"schedules"`
+	Config              DebugConfig                 `json:"config"`
+}
+
+// DebugConfig ...
+type DebugConfig struct {
+	MaintenanceIDs []int    `json:"maintenance_ids"`
+	PollInterval   int      `json:"poll_interval"`
+	BaseURL        string   `json:"base_url"`
+	CheckTags      []string `json:"check_tags"`
+	AndTags        []string `json:"and_tags"`
+	ExcludeTags    []string `json:"exclude_tags"`
+	CheckTypes     []string `json:"check_types"`
+	Window         string   `json:"window"`
+	Timezone       string   `json:"timezone"`
+	IncludeTms     bool     `json:"include_tms"`
+	DryRun         bool     `json:"dry_run"`
+}
+
+// snapshot of the poll state and configuration, secrets are left out
+func (s *PollState) debugState(e *Env) DebugState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	schedules := map[int]MaintenanceSchedule{}
+	for id, m := range s.schedules {
+		schedules[id] = m
+	}
+	return DebugState{
+		LastPoll:            s.lastPoll,
+		LastSuccess:         s.lastSuccess,
+		ConsecutiveFailures: s.consecutiveFailures,
+		UptimeChecks:        s.uptimeChecks,
+		TmsChecks:           s.tmsChecks,
+		Schedules:           schedules,
+		Config: DebugConfig{
+			MaintenanceIDs: e.maintenanceIDs,
+			PollInterval:   e.pollInterval,
+			BaseURL:        e.pingdom.baseURL,
+			CheckTags:      e.checkTags,
+			AndTags:        e.andTags,
+			ExcludeTags:    e.excludeTags,
+			CheckTypes:     e.checkTypes,
+			Window:         e.windowFrom.String() + "-" + e.windowTo.String(),
+			Timezone:       e.location.String(),
+			IncludeTms:     e.includeTms,
+			DryRun:         e.dryRun,
+		},
+	}
+}
+
+// liveness probe
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+// readiness probe
+func readyzHandler(e *Env) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !state.ready(e.readyFailures) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not ready\n"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	}
+}
+
+// dump the poll state and current configuration
+func debugStateHandler(store *EnvStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(state.debugState(store.get()))
+	}
+}
+
+// list the checks in scope as of the last poll, from memory rather than the
+// api
+func checksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(state.checkList())
+}
+
+// trigger a reconcile cycle and reply with its summary
+func reconcileHandler(trigger chan<- chan ReconcileSummary) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// buffered so the poll loop never blocks on a client that went away
+		reply := make(chan ReconcileSummary, 1)
+		select {
+		case trigger <- reply:
+		case <-r.Context().Done():
+			return
+		}
+		select {
+		case summary := <-reply:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(summary)
+		case <-r.Context().Done():
+		}
+	}
+}
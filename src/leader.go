@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Lease ...
+type Lease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// LeaderElector ...
+type LeaderElector struct {
+	mu       sync.Mutex
+	path     string
+	identity string
+	duration time.Duration
+	leader   bool
+	expires  time.Time
+}
+
+// elect a leader between replicas sharing the lease file at path
+func newLeaderElector(path string, identity string, duration time.Duration) *LeaderElector {
+	return &LeaderElector{path: path, identity: identity, duration: duration}
+}
+
+// identity of this replica in the lease, the hostname is the pod name on
+// kubernetes
+func leaderIdentity() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// read the lease file
+func readLease(path string) (Lease, error) {
+	var l Lease
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return l, err
+	}
+	err = json.Unmarshal(data, &l)
+	return l, err
+}
+
+// replace the lease file atomically
+func writeLease(path string, l Lease) error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// hold an exclusive flock on path.lock, the kernel drops it when a replica
+// dies so a crash never leaves the lease locked
+func lockLease(path string) (*os.File, error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// release a lock taken by lockLease
+func unlockLease(f *os.File) {
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	f.Close()
+}
+
+// take the lease when it is free or expired and renew it when we hold it,
+// returns whether this replica is the leader. Reading, checking and writing
+// the lease happens under the lease lock so two replicas never both take a
+// free lease
+func (l *LeaderElector) elect(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	leader, err := l.tryAcquire(now)
+	if err != nil {
+		logError("leader_election", err, "Leader lease %s", l.path)
+	}
+	if leader != l.leader {
+		if leader {
+			logInfof("Acquired leader lease %s as %s", l.path, l.identity)
+		} else {
+			logInfof("Lost leader lease %s, not updating maintenance schedules", l.path)
+		}
+	}
+	l.leader = leader
+	if leader {
+		l.expires = now.Add(l.duration)
+	}
+	return leader
+}
+
+func (l *LeaderElector) tryAcquire(now time.Time) (bool, error) {
+	lock, err := lockLease(l.path)
+	if err != nil {
+		return false, err
+	}
+	defer unlockLease(lock)
+	current, err := readLease(l.path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err == nil && current.Holder != l.identity && now.Before(current.Expires) {
+		return false, nil
+	}
+	if err := writeLease(l.path, Lease{Holder: l.identity, Expires: now.Add(l.duration)}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// whether this replica took the lease at the last election and it has not
+// expired since, a stalled leader stops updating once another replica may
+// have taken over
+func (l *LeaderElector) isLeader() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leader && time.Now().Before(l.expires)
+}
+
+// true if this replica may update maintenance schedules, always without
+// leader election
+func (e *Env) isLeader() bool {
+	return e.leader == nil || e.leader.isLeader()
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLeaderElectionSingleLeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease")
+	now := time.Now()
+	a := newLeaderElector(path, "a", time.Minute)
+	b := newLeaderElector(path, "b", time.Minute)
+
+	if !a.elect(now) {
+		t.Fatal("a did not take a free lease")
+	}
+	if b.elect(now.Add(time.Second)) {
+		t.Fatal("b took a lease held by a")
+	}
+	if !a.elect(now.Add(2 * time.Second)) {
+		t.Fatal("a could not renew its own lease")
+	}
+	if !a.isLeader() || b.isLeader() {
+		t.Fatalf("isLeader a=%v b=%v, want a only", a.isLeader(), b.isLeader())
+	}
+}
+
+func TestLeaderElectionTakeoverAfterExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease")
+	now := time.Now()
+	a := newLeaderElector(path, "a", time.Minute)
+	b := newLeaderElector(path, "b", time.Minute)
+
+	if !a.elect(now) {
+		t.Fatal("a did not take a free lease")
+	}
+	if b.elect(now.Add(59 * time.Second)) {
+		t.Fatal("b took the lease before it expired")
+	}
+	if !b.elect(now.Add(61 * time.Second)) {
+		t.Fatal("b did not take over an expired lease")
+	}
+	if a.elect(now.Add(62 * time.Second)) {
+		t.Fatal("a kept leading after b took over")
+	}
+	lease, err := readLease(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lease.Holder != "b" {
+		t.Fatalf("lease holder %q, want b", lease.Holder)
+	}
+}
+
+func TestLeaderExpiresWithoutRenewal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease")
+	a := newLeaderElector(path, "a", time.Minute)
+	if !a.elect(time.Now().Add(-2 * time.Minute)) {
+		t.Fatal("a did not take a free lease")
+	}
+	if a.isLeader() {
+		t.Fatal("a still leader after its lease expired")
+	}
+}
+
+func TestLeaderElectionConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lease")
+	now := time.Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	leaders := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			l := newLeaderElector(path, string(rune('a'+i)), time.Minute)
+			if l.elect(now) {
+				mu.Lock()
+				leaders++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if leaders != 1 {
+		t.Fatalf("%d replicas took a free lease, want 1", leaders)
+	}
+}
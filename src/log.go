@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// LogEntry ...
+type LogEntry struct {
+	Time      string `json:"time"`
+	Level     string `json:"level"`
+	Msg       string `json:"msg"`
+	Operation string `json:"operation,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// log output format, text or json
+var logFormat = "text"
+
+// log levels in increasing severity
+var logLevels = map[string]int{
+	"debug": 0,
+	"info":  1,
+	"warn":  2,
+	"error": 3,
+	"fatal": 4,
+}
+
+// minimum level that is logged
+var logLevel = "info"
+
+// set the log output format
+func setLogFormat(format string) {
+	switch format {
+	case "", "text":
+		logFormat = "text"
+	case "json":
+		logFormat = "json"
+		log.SetFlags(0)
+	default:
+		log.Fatalf("Could not parse env LOG_FORMAT: expected text or json, got %s", format)
+	}
+}
+
+// set the minimum log level
+func setLogLevel(level string) {
+	if level == "" {
+		level = "info"
+	}
+	if _, ok := logLevels[level]; !ok || level == "fatal" {
+		log.Fatalf("Could not parse env LOG_LEVEL: expected debug, info, warn or error, got %s", level)
+	}
+	logLevel = level
+}
+
+// write a single log line in the configured format
+func logEntry(level string, operation string, msg string, err error) {
+	if logLevels[level] < logLevels[logLevel] {
+		return
+	}
+	if logFormat == "json" {
+		entry := LogEntry{
+			Time:      time.Now().UTC().Format(time.RFC3339),
+			Level:     level,
+			Msg:       msg,
+			Operation: operation,
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		line, _ := json.Marshal(entry)
+		log.Print(string(line))
+		return
+	}
+	if err != nil {
+		log.Printf("\t%s: [%s] - %s", msg, strings.ToUpper(level), err)
+		return
+	}
+	log.Printf("\t%s", msg)
+}
+
+// log a debug message
+func logDebugf(format string, v ...interface{}) {
+	logEntry("debug", "", fmt.Sprintf(format, v...), nil)
+}
+
+// log an informational message
+func logInfof(format string, v ...interface{}) {
+	logEntry("info", "", fmt.Sprintf(format, v...), nil)
+}
+
+// log a warning
+func logWarnf(format string, v ...interface{}) {
+	logEntry("warn", "", fmt.Sprintf(format, v...), nil)
+}
+
+// log a failed operation
+func logError(operation string, err error, format string, v ...interface{}) {
+	logEntry("error", operation, fmt.Sprintf(format, v...), err)
+}
+
+// log a message and exit
+func logFatalf(format string, v ...interface{}) {
+	logEntry("fatal", "", fmt.Sprintf(format, v...), nil)
+	os.Exit(1)
+}
@@ -1,139 +1,523 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"crypto/tls"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
 )
 
 // Env ...
 type Env struct {
-	apiKey        string
-	maintenanceID int
-	pollInterval  int
-	metricsPort   string
-}
-
-// PingdomMaintenanceSchedules ...
-type PingdomMaintenanceSchedules struct {
-	Maintenance []MaintenanceSchedule `json:"maintenance"`
-}
-
-// PingdomMaintenanceSchedule ...
-type PingdomMaintenanceSchedule struct {
-	Maintenance MaintenanceSchedule `json:"maintenance"`
-}
-
-// MaintenanceSchedule ...
-type MaintenanceSchedule struct {
-	ID               int    `json:"id"`
-	Description      string `json:"description"`
-	From             int    `json:"from"`
-	To               int    `json:"to"`
-	Duration         int    `json:"duration"`
-	Durationunit     string `json:"durationunit"`
-	Recurrencetype   string `json:"recurrencetype"`
-	Repeatevery      int    `json:"repeatevery"`
-	Dayofweekinmonth int    `json:"dayofweekinmonth"`
-	Effectiveto      int    `json:"effectiveto"`
-	Checks           struct {
-		Uptime []int `json:"uptime"`
-		Tms    []int `json:"tms"`
-	} `json:"checks"`
-}
-
-// MaintenanceScheduleUpdate ...
-type MaintenanceScheduleUpdate struct {
-	Description    string `json:"description"`
-	From           int    `json:"from"`
-	To             int    `json:"to"`
-	Recurrencetype string `json:"recurrencetype"`
-	Repeatevery    int    `json:"repeatevery"`
-	Effectiveto    int    `json:"effectiveto"`
-	Uptimeids      string `json:"uptimeids"`
-	Tmsids         string `json:"tmsids"`
-}
-
-// PingdomChecks ...
-type PingdomChecks struct {
-	Checks []struct {
-		ID                int      `json:"id"`
-		Created           int      `json:"created"`
-		Name              string   `json:"name"`
-		Hostname          string   `json:"hostname"`
-		Resolution        int      `json:"resolution"`
-		Type              string   `json:"type"`
-		Ipv6              bool     `json:"ipv6"`
-		VerifyCertificate bool     `json:"verify_certificate"`
-		Lasterrortime     int      `json:"lasterrortime"`
-		Lasttesttime      int      `json:"lasttesttime"`
-		Lastresponsetime  int      `json:"lastresponsetime"`
-		Status            string   `json:"status"`
-		Maintenanceids    []string `json:"maintenanceids,omitempty"`
-	} `json:"checks"`
-	Counts struct {
-		Total    int `json:"total"`
-		Limited  int `json:"limited"`
-		Filtered int `json:"filtered"`
-	} `json:"counts"`
-}
-
-var (
-	slaTotal = promauto.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "ps_pingdom_maintenance_sla_total",
-			Help: "Total uptime SLA checks",
-		})
-	slaMaintenance = promauto.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "ps_pingdom_maintenance_sla_maintenance",
-			Help: "The number of SLA checks in the maintenance schedule",
-		})
-)
+	maintenanceIDs  []int
+	pollInterval    int
+	readyFailures   int
+	metricsPort     string
+	metricsUser     string
+	metricsPassword string
+	tlsCertFile     string
+	tlsKeyFile      string
+	// for webhooks and the pushgateway, pingdom requests go through pingdom
+	notifyClient   *http.Client
+	pingdom        *PingdomClient
+	checkTags      []string
+	excludeTags    []string
+	windowFrom     ClockTime
+	windowTo       ClockTime
+	windowFromDays map[time.Weekday]ClockTime
+	windowToDays   map[time.Weekday]ClockTime
+	location       *time.Location
+	// sent as the schedule timezone, empty keeps the timezone of the schedule
+	scheduleTimezone    string
+	dryRun              bool
+	createIfMissing     bool
+	webhookURL          string
+	descriptionTemplate string
+	slackWebhookURL     string
+	recurrenceType      string
+	includeTms          bool
+	checkTypes          []string
+	allowedUpdateHours  *HourRange
+	pollJitter          bool
+	stateFile           string
+	effectiveToDays     int
+	verifyAfterUpdate   bool
+	checkNamePrefix     string
+	maxConcurrency      int
+	andTags             []string
+	allowEmpty          bool
+	minChanged          int
+	exitOnAuthFailure   bool
+	minResolution       int
+	maxResolution       int
+	exemptCheckIDs      []int
+	// nil without leader election
+	leader *LeaderElector
+	// appended to the description, empty leaves it as is
+	managedByMarker   string
+	allowActiveUpdate bool
+	// log a summary every this many polls, 0 never
+	summaryEvery int
+	// description of a schedule added to maintenanceIDs by resolveName
+	maintenanceName string
+}
+
+// ScheduleDiff ...
+type ScheduleDiff struct {
+	Added   []int `json:"added"`
+	Removed []int `json:"removed"`
+}
+
+func (d ScheduleDiff) String() string {
+	return fmt.Sprintf("added=[%s] removed=[%s]", intSliceToString(d.Added), intSliceToString(d.Removed))
+}
+
+// ReconcileResult ...
+type ReconcileResult struct {
+	MaintenanceID int           `json:"maintenance_id"`
+	Status        string        `json:"status"`
+	CreatedID     int           `json:"created_id,omitempty"`
+	Diff          *ScheduleDiff `json:"diff,omitempty"`
+	Error         string        `json:"error,omitempty"`
+}
+
+func (r ReconcileResult) failed(err error) ReconcileResult {
+	r.Status = "error"
+	r.Error = err.Error()
+	return r
+}
+
+// ReconcileSummary ...
+type ReconcileSummary struct {
+	Results []ReconcileResult `json:"results"`
+	Error   string            `json:"error,omitempty"`
+	// pingdom rejected the api key
+	unauthorized bool
+}
+
+// ClockTime ...
+type ClockTime struct {
+	hour   int
+	minute int
+}
+
+func (c ClockTime) String() string {
+	return fmt.Sprintf("%02d:%02d", c.hour, c.minute)
+}
+
+// HourRange ...
+type HourRange struct {
+	from int
+	to   int
+}
+
+// true if hour is in the range, the end hour is excluded and a range ending
+// before it starts wraps around midnight
+func (r HourRange) contains(hour int) bool {
+	if r.from <= r.to {
+		return hour >= r.from && hour < r.to
+	}
+	return hour >= r.from || hour < r.to
+}
 
-// environment variables
-func newEnv(
-	apiKey string,
-	maintenanceID int,
-	pollInterval int,
-	metricsPort string) *Env {
-	if apiKey == "" {
-		log.Fatalf("Could not parse env API_KEY")
+func (r HourRange) String() string {
+	return fmt.Sprintf("%d-%d", r.from, r.to)
+}
+
+// upper bound for the poll interval when backing off after failures
+const maxBackoff = 15 * time.Minute
+
+// largest change of a jittered poll interval, as a fraction of it
+const pollJitterFraction = 0.1
+
+// how long in-flight requests get to finish on shutdown
+const shutdownGracePeriod = 5 * time.Second
+
+// marker appended to descriptions unless MANAGED_BY_MARKER is set
+const defaultManagedByMarker = "[managed-by: ps-pingdom-maintenance]"
+
+// EnvOptions ...
+type EnvOptions struct {
+	apiKey              string
+	apiKeyFile          string
+	maintenanceIDs      []int
+	pollInterval        int
+	readyFailures       int
+	metricsPort         string
+	metricsUser         string
+	metricsPassword     string
+	tlsCertFile         string
+	tlsKeyFile          string
+	baseURL             string
+	httpTimeout         int
+	maxRetries          int
+	checkTags           string
+	excludeTags         string
+	windowFrom          string
+	windowTo            string
+	windowFromDays      map[time.Weekday]string
+	windowToDays        map[time.Weekday]string
+	timezone            string
+	dryRun              bool
+	createIfMissing     bool
+	webhookURL          string
+	descriptionTemplate string
+	slackWebhookURL     string
+	recurrenceType      string
+	includeTms          bool
+	checkTypes          string
+	allowedUpdateHours  string
+	accountEmail        string
+	pollJitter          bool
+	stateFile           string
+	effectiveToDays     int
+	verifyAfterUpdate   bool
+	checkNamePrefix     string
+	recheckBeforeUpdate bool
+	proxyURL            string
+	insecureSkipVerify  bool
+	maxConcurrency      int
+	andTags             string
+	allowEmpty          bool
+	minChanged          int
+	exitOnAuthFailure   bool
+	userAgent           string
+	minResolution       int
+	maxResolution       int
+	exemptCheckIDs      string
+	leaderElection      bool
+	leaderLeaseFile     string
+	leaderLeaseDuration int
+	managedByMarker     string
+	allowActiveUpdate   bool
+	maintenanceName     string
+	summaryEvery        int
+}
+
+// environment variables, defaults are applied to the unset options
+func newEnv(o EnvOptions) *Env {
+	var err error
+	o.apiKey, err = readAPIKey(o.apiKey, o.apiKeyFile)
+	if err != nil {
+		logFatalf("Could not read env API_KEY_FILE: %s", err)
+	}
+	if o.apiKey == "" {
+		logFatalf("Could not parse env API_KEY or API_KEY_FILE")
+	}
+	if len(o.maintenanceIDs) == 0 && o.maintenanceName == "" {
+		logFatalf("Could not parse env MAINTENANCE_ID or MAINTENANCE_NAME")
+	}
+	if o.pollInterval == 0 {
+		o.pollInterval = 300
+	}
+	if o.readyFailures == 0 {
+		o.readyFailures = 3
+	}
+	if o.userAgent == "" {
+		o.userAgent = "ps-pingdom-maintenance/" + version
+	}
+	if o.metricsPort == "" {
+		o.metricsPort = "9600"
+	}
+	if _, err := parsePort(o.metricsPort); err != nil {
+		logFatalf("Could not parse env METRICS_PORT: %s", err)
+	}
+	if (o.tlsCertFile == "") != (o.tlsKeyFile == "") {
+		logFatalf("Could not parse env TLS_CERT_FILE and TLS_KEY_FILE: both must be set")
+	}
+	if o.tlsCertFile != "" {
+		if _, err := tls.LoadX509KeyPair(o.tlsCertFile, o.tlsKeyFile); err != nil {
+			logFatalf("Could not load env TLS_CERT_FILE and TLS_KEY_FILE: %s", err)
+		}
+	}
+	// normalize trailing slash
+	o.baseURL = strings.TrimRight(o.baseURL, "/")
+	if o.baseURL == "" {
+		o.baseURL = "https://api.pingdom.com"
 	}
-	if maintenanceID == 0 {
-		log.Fatalf("Could not parse env MAINTENANCE_ID")
+	if o.httpTimeout == 0 {
+		o.httpTimeout = 30
 	}
-	if pollInterval == 0 {
-		pollInterval = 300
+	if o.maxRetries == 0 {
+		o.maxRetries = 3
 	}
-	if metricsPort == "" {
-		metricsPort = "9600"
+	if o.minChanged < 0 {
+		logFatalf("Could not parse env MIN_CHANGED: must be a positive number")
+	}
+	if o.minChanged == 0 {
+		o.minChanged = 1
+	}
+	exempt := parseIntList(o.exemptCheckIDs)
+	if exempt == nil {
+		logFatalf("Could not parse env EXEMPT_CHECK_IDS: %s", o.exemptCheckIDs)
+	}
+	var leader *LeaderElector
+	if o.leaderElection {
+		if o.leaderLeaseFile == "" {
+			logFatalf("Could not parse env LEADER_LEASE_FILE: required with ENABLE_LEADER_ELECTION")
+		}
+		if o.leaderLeaseDuration < 0 {
+			logFatalf("Could not parse env LEADER_LEASE_DURATION: must be a positive number")
+		}
+		// the leader renews the lease every poll, leave room for a slow one
+		if o.leaderLeaseDuration == 0 {
+			o.leaderLeaseDuration = 3 * o.pollInterval
+		}
+		leader = newLeaderElector(o.leaderLeaseFile, leaderIdentity(), time.Second*time.Duration(o.leaderLeaseDuration))
+	}
+	if o.summaryEvery < 0 {
+		logFatalf("Could not parse env SUMMARY_EVERY: must be a positive number")
+	}
+	if o.minResolution < 0 {
+		logFatalf("Could not parse env MIN_RESOLUTION: must be a positive number")
+	}
+	if o.maxResolution < 0 {
+		logFatalf("Could not parse env MAX_RESOLUTION: must be a positive number")
+	}
+	if o.maxResolution != 0 && o.minResolution > o.maxResolution {
+		logFatalf("Could not parse env MIN_RESOLUTION: %d is above MAX_RESOLUTION %d", o.minResolution, o.maxResolution)
+	}
+	if o.maxConcurrency < 0 {
+		logFatalf("Could not parse env MAX_CONCURRENCY: must be a positive number")
+	}
+	if o.maxConcurrency == 0 {
+		o.maxConcurrency = 4
+	}
+	tags := splitList(o.checkTags)
+	if len(tags) == 0 {
+		tags = []string{"sla"}
+	}
+	if o.windowFrom == "" {
+		o.windowFrom = "15:00"
+	}
+	if o.windowTo == "" {
+		o.windowTo = "06:00"
+	}
+	from, err := parseClockTime(o.windowFrom)
+	if err != nil {
+		logFatalf("Could not parse env WINDOW_FROM: %s", err)
+	}
+	to, err := parseClockTime(o.windowTo)
+	if err != nil {
+		logFatalf("Could not parse env WINDOW_TO: %s", err)
+	}
+	fromDays := map[time.Weekday]ClockTime{}
+	for day, v := range o.windowFromDays {
+		c, err := parseClockTime(v)
+		if err != nil {
+			logFatalf("Could not parse env WINDOW_FROM_%s: %s", weekdayNames[day], err)
+		}
+		fromDays[day] = c
+	}
+	toDays := map[time.Weekday]ClockTime{}
+	for day, v := range o.windowToDays {
+		c, err := parseClockTime(v)
+		if err != nil {
+			logFatalf("Could not parse env WINDOW_TO_%s: %s", weekdayNames[day], err)
+		}
+		toDays[day] = c
+	}
+	scheduleTimezone := o.timezone
+	if o.timezone == "" {
+		o.timezone = "UTC"
+	}
+	location, err := time.LoadLocation(o.timezone)
+	if err != nil {
+		logFatalf("Could not load env TIMEZONE: %s", err)
+	}
+	if o.effectiveToDays < 0 {
+		logFatalf("Could not parse env EFFECTIVE_TO_DAYS: must be a positive number of days")
+	}
+	if o.recurrenceType != "" && !recurrenceTypes[o.recurrenceType] {
+		logFatalf("Could not parse env RECURRENCE_TYPE: must be one of none, day, week or month")
+	}
+	var updateHours *HourRange
+	if o.allowedUpdateHours != "" {
+		r, err := parseHourRange(o.allowedUpdateHours)
+		if err != nil {
+			logFatalf("Could not parse env ALLOWED_UPDATE_HOURS: %s", err)
+		}
+		updateHours = &r
+	}
+	if o.stateFile != "" {
+		if err := loadState(o.stateFile); err != nil {
+			logFatalf("Could not load env STATE_FILE: %s", err)
+		}
+		seedFromState(o.maintenanceIDs)
+	}
+	var proxy *url.URL
+	if o.proxyURL != "" {
+		proxy, err = url.Parse(o.proxyURL)
+		if err != nil || proxy.Host == "" {
+			logFatalf("Could not parse env PINGDOM_PROXY_URL: %s", o.proxyURL)
+		}
+	}
+	if o.insecureSkipVerify {
+		logWarnf("PINGDOM_INSECURE_SKIP_VERIFY is set, TLS certificates of the Pingdom API are not verified")
+	}
+	// webhooks and the pushgateway never use the pingdom proxy and tls settings
+	notifyClient := &http.Client{
+		Timeout:   time.Second * time.Duration(o.httpTimeout),
+		Transport: http.DefaultTransport.(*http.Transport).Clone(),
 	}
 	e := Env{
-		apiKey:        apiKey,
-		maintenanceID: maintenanceID,
-		pollInterval:  pollInterval,
-		metricsPort:   metricsPort,
+		maintenanceIDs:  o.maintenanceIDs,
+		pollInterval:    o.pollInterval,
+		readyFailures:   o.readyFailures,
+		metricsPort:     o.metricsPort,
+		metricsUser:     o.metricsUser,
+		metricsPassword: o.metricsPassword,
+		tlsCertFile:     o.tlsCertFile,
+		tlsKeyFile:      o.tlsKeyFile,
+		notifyClient:    notifyClient,
+		pingdom: newPingdomClient(PingdomOptions{
+			apiKey:             o.apiKey,
+			baseURL:            o.baseURL,
+			proxy:              proxy,
+			insecureSkipVerify: o.insecureSkipVerify,
+			dryRun:             o.dryRun,
+			// never wait longer than a poll interval on rate limits
+			maxRetryDelay:       time.Second * time.Duration(o.pollInterval),
+			maxRetries:          o.maxRetries,
+			timeout:             time.Second * time.Duration(o.httpTimeout),
+			accountEmail:        o.accountEmail,
+			recheckBeforeUpdate: o.recheckBeforeUpdate,
+			userAgent:           o.userAgent,
+		}),
+		checkTags:           tags,
+		excludeTags:         splitList(o.excludeTags),
+		windowFrom:          from,
+		windowTo:            to,
+		windowFromDays:      fromDays,
+		windowToDays:        toDays,
+		location:            location,
+		scheduleTimezone:    scheduleTimezone,
+		dryRun:              o.dryRun,
+		createIfMissing:     o.createIfMissing,
+		webhookURL:          o.webhookURL,
+		descriptionTemplate: o.descriptionTemplate,
+		slackWebhookURL:     o.slackWebhookURL,
+		recurrenceType:      o.recurrenceType,
+		includeTms:          o.includeTms,
+		checkTypes:          splitList(o.checkTypes),
+		allowedUpdateHours:  updateHours,
+		pollJitter:          o.pollJitter,
+		stateFile:           o.stateFile,
+		effectiveToDays:     o.effectiveToDays,
+		verifyAfterUpdate:   o.verifyAfterUpdate,
+		checkNamePrefix:     o.checkNamePrefix,
+		maxConcurrency:      o.maxConcurrency,
+		andTags:             splitList(o.andTags),
+		allowEmpty:          o.allowEmpty,
+		minChanged:          o.minChanged,
+		exitOnAuthFailure:   o.exitOnAuthFailure,
+		minResolution:       o.minResolution,
+		maxResolution:       o.maxResolution,
+		exemptCheckIDs:      exempt,
+		leader:              leader,
+		managedByMarker:     strings.TrimSpace(o.managedByMarker),
+		allowActiveUpdate:   o.allowActiveUpdate,
+		summaryEvery:        o.summaryEvery,
+		maintenanceName:     o.maintenanceName,
 	}
-	log.Printf("\tps-pingdom-maintenance service started...")
-	log.Printf("\tMaintenance ID: %d\tPoll Interval: %d\tMetrics port: %s\n\n", e.maintenanceID, e.pollInterval, e.metricsPort)
+	logInfof("ps-pingdom-maintenance %s service started...", version)
+	if e.dryRun {
+		logInfof("[DRY-RUN] Maintenance schedules will not be updated")
+	}
+	for _, day := range weekdays {
+		from, to := e.windowFor(day)
+		if from != e.windowFrom || to != e.windowTo {
+			logInfof("Window %s: %s-%s", weekdayNames[day], from, to)
+		}
+	}
+	logInfof("Maintenance IDs: %s\tPoll Interval: %d\tMetrics port: %s\tAPI: %s\tHTTP timeout: %d\tMax retries: %d\tTags: %s\tWindow: %s-%s %s", intSliceToString(e.maintenanceIDs), e.pollInterval, e.metricsPort, e.pingdom.baseURL, int(e.pingdom.timeout.Seconds()), e.pingdom.maxRetries, strings.Join(e.checkTags, ","), e.windowFrom, e.windowTo, e.location)
 	return &e
 }
 
+// id of the only maintenance schedule with description name, ignoring
+// the managed-by marker
+func resolveMaintenanceName(ctx context.Context, e *Env, name string) (int, error) {
+	schedules, err := e.pingdom.getPingdomMaintenanceSchedules(ctx)
+	if err != nil {
+		return 0, err
+	}
+	ids := []int{}
+	for _, m := range schedules.Maintenance {
+		description := m.Description
+		if e.managedByMarker != "" {
+			description = strings.TrimSpace(strings.Replace(description, e.managedByMarker, "", -1))
+		}
+		if description == name {
+			ids = append(ids, m.ID)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return 0, fmt.Errorf("no maintenance schedule described %q", name)
+	case 1:
+		return ids[0], nil
+	}
+	return 0, fmt.Errorf("%d maintenance schedules described %q: %s", len(ids), name, intSliceToString(ids))
+}
+
+// add the schedule described MAINTENANCE_NAME to the maintenance ids, a no-op
+// without a name. Only call before the env is shared with the poll loop
+func (e *Env) resolveName(ctx context.Context) error {
+	if e.maintenanceName == "" {
+		return nil
+	}
+	id, err := resolveMaintenanceName(ctx, e, e.maintenanceName)
+	if err != nil {
+		return err
+	}
+	logInfof("Maintenance schedule %q is %d", e.maintenanceName, id)
+	if !containsInt(e.maintenanceIDs, id) {
+		e.maintenanceIDs = append(e.maintenanceIDs, id)
+	}
+	return nil
+}
+
+// true if the flag was passed on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// the api key, read from apiKeyFile when set as it takes precedence
+func readAPIKey(apiKey string, apiKeyFile string) (string, error) {
+	if apiKeyFile == "" {
+		return apiKey, nil
+	}
+	key, err := ioutil.ReadFile(apiKeyFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(key), " \t\r\n"), nil
+}
+
 // convert env var to integer
 func getenvInt(key string) int {
 	s := os.Getenv(key)
@@ -144,127 +528,352 @@ func getenvInt(key string) int {
 	return v
 }
 
-// get a list of pingdom checks tagged sla
-func getPingdomChecks(e *Env) (PingdomChecks, error) {
-	url := `https://api.pingdom.com/api/3.1/checks?tags=sla`
-	var bearer = "Bearer " + e.apiKey
-	req, err := http.NewRequest("GET", url, nil)
-	req.Header.Add("Authorization", bearer)
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return PingdomChecks{}, err
+// env var, or def when unset
+func getenvDefault(key string, def string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// env var for the managed-by marker, the default marker when unset and no
+// marker when set empty
+func getenvMarker(key string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
 	}
-	defer resp.Body.Close()
-	// Success is indicated with 2xx status codes:
-	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
-	if !statusOK {
-		return PingdomChecks{}, errors.New("GET Pingdom checks responded with status code: " + strconv.Itoa(resp.StatusCode))
+	return defaultManagedByMarker
+}
+
+// env var as integer, or def when unset
+func getenvIntDefault(key string, def int) int {
+	if _, ok := os.LookupEnv(key); ok {
+		return getenvInt(key)
+	}
+	return def
+}
+
+// env var as a list of integers, or def when unset
+func getenvIntListDefault(key string, def []int) []int {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return getenvIntList(key)
 	}
-	body, _ := ioutil.ReadAll(resp.Body)
-	var c = PingdomChecks{}
-	err = json.Unmarshal(body, &c)
+	return def
+}
+
+// convert env var to boolean
+func getenvBool(key string) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
 	if err != nil {
-		slaTotal.Set(0)
-		return PingdomChecks{}, err
+		return false
 	}
-	slaTotal.Set(float64(len(c.Checks)))
-	return c, nil
+	return v
 }
 
-// Get pingdom maintenance schedule by id
-func getPingdomMainenanceSchedule(e *Env) (PingdomMaintenanceSchedule, error) {
-	url := fmt.Sprintf(`https://api.pingdom.com/api/3.1/maintenance/%d`, e.maintenanceID)
-	var bearer = "Bearer " + e.apiKey
-	req, err := http.NewRequest("GET", url, nil)
-	req.Header.Add("Authorization", bearer)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// convert env var to boolean, def when unset or invalid
+func getenvBoolDefault(key string, def bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
 	if err != nil {
-		slaMaintenance.Set(0)
-		return PingdomMaintenanceSchedule{}, err
-	}
-	defer resp.Body.Close()
-	// Success is indicated with 2xx status codes:
-	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
-	if !statusOK {
-		return PingdomMaintenanceSchedule{}, errors.New("GET Pingdom maintenance responded with status code: " + strconv.Itoa(resp.StatusCode))
-	}
-	body, _ := ioutil.ReadAll(resp.Body)
-	var m = PingdomMaintenanceSchedule{}
-	err = json.Unmarshal(body, &m)
+		return def
+	}
+	return v
+}
+
+// convert comma separated env var to a list of integers
+func getenvIntList(key string) []int {
+	return parseIntList(os.Getenv(key))
+}
+
+// convert comma separated string to a list of integers, nil if any is invalid
+func parseIntList(list string) []int {
+	l := []int{}
+	for _, s := range splitList(list) {
+		v, err := strconv.Atoi(s)
+		if err != nil || v == 0 {
+			return nil
+		}
+		l = append(l, v)
+	}
+	return l
+}
+
+// recurrence types accepted by pingdom
+var recurrenceTypes = map[string]bool{
+	"none":  true,
+	"day":   true,
+	"week":  true,
+	"month": true,
+}
+
+// days of the week in the order they are logged
+var weekdays = []time.Weekday{
+	time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday,
+}
+
+// env var suffix for each day of the week
+var weekdayNames = map[time.Weekday]string{
+	time.Monday:    "MON",
+	time.Tuesday:   "TUE",
+	time.Wednesday: "WED",
+	time.Thursday:  "THU",
+	time.Friday:    "FRI",
+	time.Saturday:  "SAT",
+	time.Sunday:    "SUN",
+}
+
+// collect the day specific env vars of key, e.g. WINDOW_FROM_SAT
+func getenvWeekdays(key string) map[time.Weekday]string {
+	m := map[time.Weekday]string{}
+	for _, day := range weekdays {
+		if v := os.Getenv(key + "_" + weekdayNames[day]); v != "" {
+			m[day] = v
+		}
+	}
+	return m
+}
+
+// parse a tcp port number
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(s)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, errors.New("expected a port number between 1 and 65535, got " + s)
+	}
+	return port, nil
+}
+
+// parse a HH:MM time of day
+func parseClockTime(s string) (ClockTime, error) {
+	t, err := time.Parse("15:04", s)
 	if err != nil {
-		slaMaintenance.Set(0)
-		return PingdomMaintenanceSchedule{}, err
+		return ClockTime{}, errors.New("expected HH:MM, got " + s)
 	}
-	slaMaintenance.Set(float64(len(m.Maintenance.Checks.Uptime)))
-	return m, nil
+	return ClockTime{hour: t.Hour(), minute: t.Minute()}, nil
 }
 
-// convert []int to comma separated string
+// parse a H-H range of hours
+func parseHourRange(s string) (HourRange, error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return HourRange{}, errors.New("expected H-H, got " + s)
+	}
+	from, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil || from < 0 || from > 23 {
+		return HourRange{}, errors.New("expected H-H, got " + s)
+	}
+	to, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil || to < 0 || to > 24 || to == from {
+		return HourRange{}, errors.New("expected H-H, got " + s)
+	}
+	return HourRange{from: from, to: to}, nil
+}
+
+// true if t is within the maintenance window as stored in pingdom
+func windowActive(m MaintenanceSchedule, t time.Time) bool {
+	now := int(t.Unix())
+	return m.From <= now && now <= m.To
+}
+
+// true if schedules may be updated at t, always when no hours are configured
+func updateAllowed(e *Env, t time.Time) bool {
+	if e.allowedUpdateHours == nil {
+		return true
+	}
+	return e.allowedUpdateHours.contains(t.In(e.location).Hour())
+}
+
+// split comma separated env var into a list, dropping empty entries
+func splitList(s string) []string {
+	l := []string{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+// convert []int to comma separated string in ascending order, so payloads
+// do not depend on the order the id's were found in
 func intSliceToString(v []int) string {
-	valuesText := []string{}
-	for i := range v {
-		number := v[i]
-		text := strconv.Itoa(number)
-		valuesText = append(valuesText, text)
-	}
-	result := strings.Join(valuesText, ",")
-	return result
-}
-
-// Update pingdom maintenance schedule
-func updatePingdomMaintenanceSchedule(e *Env, m PingdomMaintenanceSchedule) error {
-	t := time.Now()
-	from := time.Date(t.Year(), t.Month(), t.Day(), 15, 0, 0, 0, time.UTC)
-	to := time.Date(t.Year(), t.Month(), t.Day()+1, 6, 0, 0, 0, time.UTC)
-	schedule := MaintenanceScheduleUpdate{
-		Description:    m.Maintenance.Description,
-		From:           int(from.Unix()),
-		To:             int(to.Unix()),
-		Recurrencetype: m.Maintenance.Recurrencetype,
-		Repeatevery:    m.Maintenance.Repeatevery,
-		Effectiveto:    m.Maintenance.Effectiveto,
-		Uptimeids:      intSliceToString(m.Maintenance.Checks.Uptime),
-		Tmsids:         intSliceToString(m.Maintenance.Checks.Tms),
+	valuesText := make([]string, 0, len(v))
+	for _, number := range sortedCopy(v) {
+		valuesText = append(valuesText, strconv.Itoa(number))
 	}
-	url := fmt.Sprintf(`https://api.pingdom.com/api/3.1/maintenance/%d`, e.maintenanceID)
-	var bearer = "Bearer " + e.apiKey
-	// marshal MaintenanceScheduleUpdate to json
-	json, err := json.Marshal(schedule)
-	if err != nil {
-		return err
+	return strings.Join(valuesText, ",")
+}
+
+// window times for a day of the week, falling back to the default window
+func (e *Env) windowFor(day time.Weekday) (ClockTime, ClockTime) {
+	from, ok := e.windowFromDays[day]
+	if !ok {
+		from = e.windowFrom
 	}
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(json))
-	req.Header.Add("Authorization", bearer)
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
+	to, ok := e.windowToDays[day]
+	if !ok {
+		to = e.windowTo
 	}
-	defer resp.Body.Close()
-	// Success is indicated with 2xx status codes:
-	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
-	if !statusOK {
-		return errors.New("UPDATE Pingdom maintenance responded with status code: " + strconv.Itoa(resp.StatusCode))
+	return from, to
+}
+
+// compute the maintenance window starting on the day of t in the configured
+// timezone, the end rolls over to the next day when it is earlier in the day
+// than the start
+func maintenanceWindow(e *Env, t time.Time) (time.Time, time.Time) {
+	t = t.In(e.location)
+	windowFrom, windowTo := e.windowFor(t.Weekday())
+	from := time.Date(t.Year(), t.Month(), t.Day(), windowFrom.hour, windowFrom.minute, 0, 0, e.location)
+	to := time.Date(t.Year(), t.Month(), t.Day(), windowTo.hour, windowTo.minute, 0, 0, e.location)
+	if to.Before(from) {
+		to = to.AddDate(0, 0, 1)
 	}
-	response, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return err
+	return from, to
+}
+
+// description with the marker at the end exactly once, copies of it
+// elsewhere are removed so it never piles up across updates
+func withMarker(description string, marker string) string {
+	if marker == "" {
+		return description
 	}
-	log.Printf("\tPUT: %s", json)
-	log.Printf("\tRESPONSE: %s", response)
-	return nil
+	description = strings.TrimSpace(strings.Replace(description, marker, "", -1))
+	if description == "" {
+		return marker
+	}
+	return description + " " + marker
 }
 
-// get a list of pingdom check id's
+// render the description template, replacing {date} and {count}
+func renderDescription(template string, t time.Time, count int) string {
+	r := strings.NewReplacer(
+		"{date}", t.Format("2006-01-02"),
+		"{count}", strconv.Itoa(count),
+	)
+	return r.Replace(template)
+}
+
+// end date of the recurring schedule EFFECTIVE_TO_DAYS from now, an end date
+// in the past would end a recurring window
+func effectiveToFromDays(now time.Time, days int) (int, error) {
+	effectiveTo := now.AddDate(0, 0, days)
+	if !effectiveTo.After(now) {
+		return 0, fmt.Errorf("invalid effectiveto: %s is not in the future", effectiveTo.UTC().Format(time.RFC3339))
+	}
+	return int(effectiveTo.Unix()), nil
+}
+
+// build the update payload for a maintenance schedule, the schedule's own
+// effectiveto is passed through as is unless EFFECTIVE_TO_DAYS is set
+func newMaintenanceScheduleUpdate(e *Env, m PingdomMaintenanceSchedule) (MaintenanceScheduleUpdate, error) {
+	now := time.Now()
+	from, to := maintenanceWindow(e, now)
+	description := m.Maintenance.Description
+	if e.descriptionTemplate != "" {
+		description = renderDescription(e.descriptionTemplate, now.In(e.location), len(m.Maintenance.Checks.Uptime))
+	}
+	description = withMarker(description, e.managedByMarker)
+	recurrenceType := m.Maintenance.Recurrencetype
+	if e.recurrenceType != "" {
+		recurrenceType = e.recurrenceType
+	}
+	effectiveTo := m.Maintenance.Effectiveto
+	if e.effectiveToDays > 0 {
+		var err error
+		if effectiveTo, err = effectiveToFromDays(now, e.effectiveToDays); err != nil {
+			return MaintenanceScheduleUpdate{}, err
+		}
+	}
+	// send the timezone back so the update does not reset it
+	timezone := m.Maintenance.Timezone
+	if e.scheduleTimezone != "" {
+		timezone = e.scheduleTimezone
+	}
+	// leave tms checks out of the payload entirely when disabled
+	var tmsIDs *string
+	if e.includeTms {
+		s := intSliceToString(m.Maintenance.Checks.Tms)
+		tmsIDs = &s
+	}
+	return MaintenanceScheduleUpdate{
+		Description:    description,
+		From:           int(from.Unix()),
+		To:             int(to.Unix()),
+		Recurrencetype: recurrenceType,
+		Repeatevery:    m.Maintenance.Repeatevery,
+		Effectiveto:    effectiveTo,
+		Uptimeids:      intSliceToString(m.Maintenance.Checks.Uptime),
+		Tmsids:         tmsIDs,
+		Timezone:       timezone,
+	}, nil
+}
+
+// get a sorted list of unique pingdom check id's
 func getUptimeIds(c PingdomChecks) []int {
 	var i []int
 	for _, check := range c.Checks {
 		i = append(i, check.ID)
 	}
-	return i
+	return uniqueSorted(i)
+}
+
+// get a sorted list of unique pingdom transaction check id's
+func getTmsIds(c PingdomTmsChecks) []int {
+	var i []int
+	for _, check := range c.Checks {
+		i = append(i, check.ID)
+	}
+	return uniqueSorted(i)
+}
+
+// sort a []int and drop duplicates
+func uniqueSorted(v []int) []int {
+	s := sortedCopy(v)
+	u := []int{}
+	for i, id := range s {
+		if i == 0 || id != s[i-1] {
+			u = append(u, id)
+		}
+	}
+	return u
+}
+
+// map check id's to their names
+func checkNames(c PingdomChecks, tc PingdomTmsChecks) map[int]string {
+	names := map[int]string{}
+	for _, check := range c.Checks {
+		names[check.ID] = check.Name
+	}
+	for _, check := range tc.Checks {
+		names[check.ID] = check.Name
+	}
+	return names
+}
+
+// id's in b but not in a, and id's in a but not in b, in ascending order
+func diffIDs(a, b []int) ([]int, []int) {
+	inA := map[int]bool{}
+	for _, v := range a {
+		inA[v] = true
+	}
+	inB := map[int]bool{}
+	for _, v := range b {
+		inB[v] = true
+	}
+	added := []int{}
+	for v := range inB {
+		if !inA[v] {
+			added = append(added, v)
+		}
+	}
+	removed := []int{}
+	for v := range inA {
+		if !inB[v] {
+			removed = append(removed, v)
+		}
+	}
+	sort.Ints(added)
+	sort.Ints(removed)
+	return added, removed
 }
 
 // compare two []int
@@ -280,73 +889,637 @@ func compareSlice(a, b []int) bool {
 	return true
 }
 
-func checkMaintenanceSchedule(m PingdomMaintenanceSchedule, u []int) (bool, PingdomMaintenanceSchedule) {
+// return a sorted copy of a []int
+func sortedCopy(v []int) []int {
+	s := make([]int, len(v))
+	copy(s, v)
+	sort.Ints(s)
+	return s
+}
+
+// check if the maintenance schedule contains exactly the uptime and tms ids, ignoring order,
+// and return the updated schedule along with the id's added and removed. The id's are
+// replaced wholesale, so checks that lost their tag are removed as well as new ones added.
+// Fewer than minChanged id's added and removed counts as up to date, the original schedule
+// is returned along with the diff
+func checkMaintenanceSchedule(m PingdomMaintenanceSchedule, u []int, t []int, minChanged int) (bool, PingdomMaintenanceSchedule, ScheduleDiff) {
+	original := m
 	upToDate := true
+	diff := ScheduleDiff{Added: []int{}, Removed: []int{}}
 
-	if !compareSlice(m.Maintenance.Checks.Uptime, u) {
+	if !compareSlice(sortedCopy(m.Maintenance.Checks.Uptime), sortedCopy(u)) {
 		upToDate = false
+		added, removed := diffIDs(m.Maintenance.Checks.Uptime, u)
+		diff.Added = append(diff.Added, added...)
+		diff.Removed = append(diff.Removed, removed...)
 		m.Maintenance.Checks.Uptime = u
 	}
-	return upToDate, m
+	if !compareSlice(sortedCopy(m.Maintenance.Checks.Tms), sortedCopy(t)) {
+		upToDate = false
+		added, removed := diffIDs(m.Maintenance.Checks.Tms, t)
+		diff.Added = append(diff.Added, added...)
+		diff.Removed = append(diff.Removed, removed...)
+		m.Maintenance.Checks.Tms = t
+	}
+	if !upToDate && minChanged > 1 && len(diff.Added)+len(diff.Removed) < minChanged {
+		return true, original, diff
+	}
+	return upToDate, m, diff
 }
 
-func pollAPI(e *Env) {
-	ticker := time.NewTicker(time.Second * time.Duration(e.pollInterval)).C
-	for {
-		select {
-		case <-ticker:
-			// get uptime checks
-			c, err := getPingdomChecks(e)
-			if err != nil {
-				log.Printf("\tPingdom checks: [ERROR] - %s", err)
-				break
+// build the create payload for a new daily maintenance schedule covering the uptime and tms ids
+func newMaintenanceScheduleCreate(e *Env, u []int, t []int) (MaintenanceScheduleCreate, error) {
+	now := time.Now()
+	from, to := maintenanceWindow(e, now)
+	recurrenceType := "day"
+	if e.recurrenceType != "" {
+		recurrenceType = e.recurrenceType
+	}
+	effectiveTo := 0
+	if e.effectiveToDays > 0 {
+		var err error
+		if effectiveTo, err = effectiveToFromDays(now, e.effectiveToDays); err != nil {
+			return MaintenanceScheduleCreate{}, err
+		}
+	}
+	return MaintenanceScheduleCreate{
+		Description:    withMarker("ps-pingdom-maintenance", e.managedByMarker),
+		From:           int(from.Unix()),
+		To:             int(to.Unix()),
+		Recurrencetype: recurrenceType,
+		Repeatevery:    1,
+		Effectiveto:    effectiveTo,
+		Uptimeids:      intSliceToString(u),
+		Tmsids:         intSliceToString(t),
+		Timezone:       e.scheduleTimezone,
+	}, nil
+}
+
+// re-fetch a schedule after updating it and check pingdom stored the uptime
+// ids that were sent, a mismatch is logged and counted but does not fail the
+// reconcile
+func verifyUpdate(ctx context.Context, e *Env, id int, sent PingdomMaintenanceSchedule) {
+	m, err := e.pingdom.getPingdomMainenanceSchedule(ctx, id)
+	if err != nil {
+		logError("verify_maintenance", err, "Pingdom verify maintenance schedule %d", id)
+		return
+	}
+	if !compareSlice(sortedCopy(m.Maintenance.Checks.Uptime), sortedCopy(sent.Maintenance.Checks.Uptime)) {
+		added, removed := diffIDs(sent.Maintenance.Checks.Uptime, m.Maintenance.Checks.Uptime)
+		logWarnf("Maintenance schedule %d does not match the update: stored extra=[%s] missing=[%s]", id, intSliceToString(added), intSliceToString(removed))
+		verifyFailures.WithLabelValues(strconv.Itoa(id)).Inc()
+	}
+}
+
+// run a single reconcile cycle, returns the result for each maintenance
+// schedule and the last error encountered
+func reconcile(ctx context.Context, e *Env) ([]ReconcileResult, error) {
+	results := []ReconcileResult{}
+	// get uptime checks
+	c, err := e.pingdom.getPingdomChecks(ctx, e.checkTags)
+	if err != nil {
+		logError("get_checks", err, "Pingdom checks")
+		return results, err
+	}
+	// exclude wins over include
+	c = excludeTagged(c, e.excludeTags)
+	c = excludeIDs(c, e.exemptCheckIDs)
+	c = requireTags(c, e.andTags)
+	c = filterTypes(c, e.checkTypes)
+	c = filterNamePrefix(c, e.checkNamePrefix)
+	c = filterResolution(c, e.minResolution, e.maxResolution)
+	// only the checks that end up in the maintenance schedules
+	slaTotal.Set(float64(len(c.Checks)))
+	recordCheckStatus(c)
+	// get uptime check id's
+	u := getUptimeIds(c)
+	// get transaction checks
+	tc := PingdomTmsChecks{}
+	if e.includeTms {
+		tc, err = e.pingdom.getPingdomTmsChecks(ctx, e.checkTags)
+		if err != nil {
+			logError("get_tms_checks", err, "Pingdom TMS checks")
+			return results, err
+		}
+		tc = excludeTaggedTms(tc, e.excludeTags)
+		tc = requireTagsTms(tc, e.andTags)
+	}
+	t := getTmsIds(tc)
+	state.recordChecks(c, tc)
+	results = make([]ReconcileResult, len(e.maintenanceIDs))
+	errs := make([]error, len(e.maintenanceIDs))
+	// bounded number of schedules in flight at once
+	sem := make(chan struct{}, e.maxConcurrency)
+	var wg sync.WaitGroup
+	for i, id := range e.maintenanceIDs {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i, id int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// a panic here would not reach the recover in safePoll
+			defer func() {
+				if r := recover(); r != nil {
+					err := fmt.Errorf("panic: %v", r)
+					logError("reconcile", err, "Maintenance schedule %d\n%s", id, debug.Stack())
+					panics.Inc()
+					results[i], errs[i] = ReconcileResult{MaintenanceID: id}.failed(err), err
+				}
+			}()
+			results[i], errs[i] = reconcileSchedule(ctx, e, id, u, t, c, tc)
+		}(i, id)
+	}
+	wg.Wait()
+	logReconcileSummary(results)
+	var cycleErr error
+	for _, err := range errs {
+		if err != nil {
+			cycleErr = err
+		}
+	}
+	return results, cycleErr
+}
+
+// reconcile one maintenance schedule with the uptime and tms ids, a missing
+// schedule is created and its id returned in the result for the poll loop to
+// swap in. Returns the result and the error that failed it
+func reconcileSchedule(ctx context.Context, e *Env, id int, u []int, t []int, c PingdomChecks, tc PingdomTmsChecks) (ReconcileResult, error) {
+	result := ReconcileResult{MaintenanceID: id}
+	// get maintenance window
+	m, err := e.pingdom.getPingdomMainenanceSchedule(ctx, id)
+	if err == errNotFound && e.createIfMissing && e.isLeader() {
+		create, err := newMaintenanceScheduleCreate(e, u, t)
+		if err != nil {
+			logError("create_maintenance", err, "Pingdom create maintenance schedule")
+			return result.failed(err), err
+		}
+		newID, err := e.pingdom.createPingdomMaintenanceSchedule(ctx, create)
+		if err != nil {
+			logError("create_maintenance", err, "Pingdom create maintenance schedule")
+			return result.failed(err), err
+		}
+		if newID != 0 {
+			logInfof("Pingdom maintenance %d not found, created maintenance schedule %d", id, newID)
+		}
+		result.Status = "created"
+		result.CreatedID = newID
+		return result, nil
+	}
+	if err != nil {
+		logError("get_maintenance", err, "Pingdom maintenance %d", id)
+		return result.failed(err), err
+	}
+	state.recordSchedule(m.Maintenance)
+	// update maintenance schedule if necessary
+	// keep the current tms checks when tms is disabled so they never drift
+	tms := t
+	if !e.includeTms {
+		tms = m.Maintenance.Checks.Tms
+	}
+	upToDate, schedule, diff := checkMaintenanceSchedule(m, u, tms, e.minChanged)
+	if !upToDate {
+		inSync.WithLabelValues(strconv.Itoa(id)).Set(0)
+		logInfof("Maintenance schedule %d out of date: %s", id, diff)
+		result.Diff = &diff
+		// no checks found is more likely a tag typo or api glitch than intended
+		if len(u) == 0 && len(m.Maintenance.Checks.Uptime) > 0 && !e.allowEmpty {
+			err := errors.New("refusing to remove all " + strconv.Itoa(len(m.Maintenance.Checks.Uptime)) + " uptime checks from maintenance schedule " + strconv.Itoa(id) + ", set ALLOW_EMPTY to allow it")
+			logError("update_maintenance", err, "Pingdom update maintenance schedule %d", id)
+			emptyRefused.WithLabelValues(strconv.Itoa(id)).Inc()
+			return result.failed(err), err
+		}
+		if !updateAllowed(e, time.Now()) {
+			logInfof("Maintenance schedule %d update deferred, outside allowed update hours %s", id, e.allowedUpdateHours)
+			result.Status = "deferred"
+			return result, nil
+		}
+		// changing a window in progress confuses pingdom around the switch
+		if !e.allowActiveUpdate && windowActive(m.Maintenance, time.Now()) {
+			logInfof("Maintenance schedule %d update deferred, window active until %s", id, time.Unix(int64(m.Maintenance.To), 0).In(e.location).Format(time.RFC3339))
+			activeDeferred.WithLabelValues(strconv.Itoa(id)).Inc()
+			result.Status = "deferred"
+			return result, nil
+		}
+		if !e.isLeader() {
+			logInfof("Maintenance schedule %d update left to the leader", id)
+			result.Status = "deferred"
+			return result, nil
+		}
+		update, err := newMaintenanceScheduleUpdate(e, schedule)
+		if err != nil {
+			logError("update_maintenance", err, "Pingdom update maintenance schedule %d", id)
+			return result.failed(err), err
+		}
+		err = e.pingdom.updatePingdomMaintenanceSchedule(ctx, id, update)
+		if err == errAlreadyUpToDate {
+			logInfof("Maintenance schedule %d already updated, skipping", id)
+			inSync.WithLabelValues(strconv.Itoa(id)).Set(1)
+			result.Status = "up_to_date"
+			return result, nil
+		}
+		if err != nil {
+			logError("update_maintenance", err, "Pingdom update maintenance schedule %d", id)
+			return result.failed(err), err
+		}
+		if e.verifyAfterUpdate && !e.dryRun {
+			verifyUpdate(ctx, e, id, schedule)
+		}
+		// keep a record of what was sent, failures do not fail the reconcile
+		if e.stateFile != "" && !e.dryRun {
+			if err := saveUpdate(e.stateFile, id, update); err != nil {
+				logError("state_file", err, "Write STATE_FILE")
 			}
-			// get uptime check id's
-			u := getUptimeIds(c)
-			// get maintenance window
-			m, err := getPingdomMainenanceSchedule(e)
+		}
+		logInfof("Maintenance schedule %d updated", id)
+		result.Status = "updated"
+		if !e.dryRun {
+			state.recordUpdate(time.Now())
+			slaMaintenance.WithLabelValues(strconv.Itoa(id)).Set(float64(len(schedule.Maintenance.Checks.Uptime)))
+			tmsMaintenance.WithLabelValues(strconv.Itoa(id)).Set(float64(len(schedule.Maintenance.Checks.Tms)))
+			checksAdded.WithLabelValues(strconv.Itoa(id)).Add(float64(len(diff.Added)))
+			checksRemoved.WithLabelValues(strconv.Itoa(id)).Add(float64(len(diff.Removed)))
+		}
+		// notify about the change, failures do not fail the reconcile
+		if e.webhookURL != "" && !e.dryRun {
+			err := sendWebhook(e, id, m.Maintenance.Checks.Uptime, schedule.Maintenance.Checks.Uptime)
 			if err != nil {
-				log.Printf("\tPingdom maintenance: [ERROR] - %s", err)
-				break
+				logError("webhook", err, "Webhook maintenance schedule %d", id)
 			}
-			// update maintenance schedule if necessary
-			upToDate, schedule := checkMaintenanceSchedule(m, u)
-			if !upToDate {
-				err := updatePingdomMaintenanceSchedule(e, schedule)
+		}
+		if e.slackWebhookURL != "" && !e.dryRun {
+			if len(diff.Added) > 0 || len(diff.Removed) > 0 {
+				err := sendSlack(e, id, diff, checkNames(c, tc))
 				if err != nil {
-					log.Printf("\tPingdom update maintenance schedule: [ERROR] - %s", err)
-					break
+					logError("slack", err, "Slack maintenance schedule %d", id)
 				}
-			} else {
-				log.Printf("\tMaintenance schedule up to date")
-				// get schedule again to update metric
-				_, _ = getPingdomMainenanceSchedule(e)
 			}
 		}
+	} else if len(diff.Added)+len(diff.Removed) > 0 {
+		inSync.WithLabelValues(strconv.Itoa(id)).Set(0)
+		logInfof("Maintenance schedule %d update deferred, fewer than MIN_CHANGED %d changes: %s", id, e.minChanged, diff)
+		result.Diff = &diff
+		result.Status = "deferred"
+	} else {
+		inSync.WithLabelValues(strconv.Itoa(id)).Set(1)
+		logDebugf("Maintenance schedule %d up to date", id)
+		result.Status = "up_to_date"
 	}
+	return result, nil
 }
 
-func mainloop() {
-	exitSignal := make(chan os.Signal)
-	signal.Notify(exitSignal, syscall.SIGINT, syscall.SIGTERM)
-	<-exitSignal
-	systemTeardown()
+// log how many schedules ended in each status, at debug level when nothing changed
+func logReconcileSummary(results []ReconcileResult) {
+	counts := map[string]int{}
+	for _, r := range results {
+		counts[r.Status]++
+	}
+	statuses := []string{}
+	for status, n := range counts {
+		statuses = append(statuses, fmt.Sprintf("%s=%d", status, n))
+	}
+	sort.Strings(statuses)
+	if counts["up_to_date"] == len(results) {
+		logDebugf("Reconciled %d maintenance schedules: %s", len(results), strings.Join(statuses, " "))
+		return
+	}
+	logInfof("Reconciled %d maintenance schedules: %s", len(results), strings.Join(statuses, " "))
 }
 
-func systemTeardown() {
-	log.Printf("Shutting down...")
+// run a reconcile cycle and record the outcome, one iteration of pollAPI
+// without its timers so a cycle can be driven against a fake API by
+// building the env with its baseURL
+func poll(ctx context.Context, e *Env) ReconcileSummary {
+	if e.leader != nil {
+		e.leader.elect(time.Now())
+	}
+	isLeader.Set(0)
+	if e.isLeader() {
+		isLeader.Set(1)
+	}
+	ctx, endSpan := startSpan(ctx, "reconcile")
+	results, err := reconcile(ctx, e)
+	endSpan(0, err)
+	// a rejected key fails every poll until someone fixes it
+	unauthorized := errors.Is(err, ErrUnauthorized)
+	if unauthorized {
+		logEntry("fatal", "auth", "Pingdom rejected the API key, check API_KEY or API_KEY_FILE", err)
+	}
+	state.recordPoll(err)
+	setLastError(err)
+	summary := ReconcileSummary{Results: results, unauthorized: unauthorized}
+	if err != nil {
+		summary.Error = err.Error()
+		up.Set(0)
+	} else {
+		lastPoll.SetToCurrentTime()
+		up.Set(1)
+	}
+	return summary
+}
+
+// poll, recovering from a panic as a failed cycle so the metrics server
+// stays up
+func safePoll(ctx context.Context, e *Env) (summary ReconcileSummary) {
+	defer func() {
+		if r := recover(); r != nil {
+			err := fmt.Errorf("panic: %v", r)
+			logError("poll", err, "Poll\n%s", debug.Stack())
+			panics.Inc()
+			state.recordPoll(err)
+			up.Set(0)
+			summary = ReconcileSummary{Results: []ReconcileResult{}, Error: err.Error()}
+		}
+	}()
+	return poll(ctx, e)
+}
+
+// poll interval doubled for every consecutive failure, capped at maxBackoff
+func pollDelay(e *Env, failures int) time.Duration {
+	d := time.Second * time.Duration(e.pollInterval)
+	for i := 0; i < failures && d < maxBackoff; i++ {
+		d *= 2
+		if d > maxBackoff {
+			d = maxBackoff
+		}
+	}
+	if e.pollJitter {
+		d = jitter(d, pollJitterFraction)
+	}
+	return d
+}
+
+// d randomly moved up or down by at most fraction of itself
+func jitter(d time.Duration, fraction float64) time.Duration {
+	return d + time.Duration((rand.Float64()*2-1)*fraction*float64(d))
+}
+
+// reconcile immediately, then again after every poll interval or whenever
+// a reconcile is triggered, replying with the summary of the triggered cycle
+func pollAPI(ctx context.Context, store *EnvStore, trigger <-chan chan ReconcileSummary, fatal chan<- error) {
+	failures := 0
+	polls := 0
+	var reply chan ReconcileSummary
+	// spread the first poll of replicas started together over a poll interval
+	if e := store.get(); e.pollJitter {
+		timer := time.NewTimer(time.Duration(rand.Int63n(int64(time.Second * time.Duration(e.pollInterval)))))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case reply = <-trigger:
+			timer.Stop()
+		}
+	}
+	for {
+		// pick up reloaded configuration
+		e := store.get()
+		summary := safePoll(ctx, e)
+		store.replaceCreated(summary.Results)
+		if summary.Error != "" {
+			failures++
+		} else {
+			failures = 0
+		}
+		polls++
+		if e.summaryEvery > 0 && polls%e.summaryEvery == 0 {
+			state.logSummary()
+		}
+		if reply != nil {
+			reply <- summary
+			reply = nil
+		}
+		// leave the exit to main so it can shut down cleanly
+		if summary.unauthorized && e.exitOnAuthFailure {
+			fatal <- errors.New(summary.Error)
+			return
+		}
+		pollBackoff.Set(float64(failures))
+		// a fresh timer per cycle instead of a ticker, so a reloaded
+		// POLL_INTERVAL applies from the next cycle, and stopped on every
+		// way out of the select
+		timer := time.NewTimer(pollDelay(e, failures))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case reply = <-trigger:
+			timer.Stop()
+		}
+	}
+}
+
+// expose the running configuration, one series per maintenance schedule
+func setInfo(e *Env) {
+	info.Reset()
+	for _, id := range e.maintenanceIDs {
+		info.WithLabelValues(strconv.Itoa(id), strconv.Itoa(e.pollInterval), strings.Join(e.checkTags, ",")).Set(1)
+	}
+}
+
+// handle signals until told to stop, returns the error the poll loop gave
+// up on if that is what stopped it
+func mainloop(signals chan os.Signal, fatal <-chan error, store *EnvStore, srv *http.Server, cancel context.CancelFunc) error {
+	for {
+		select {
+		case err := <-fatal:
+			logError("auth", err, "Exiting, EXIT_ON_AUTH_FAILURE is set")
+			systemTeardown(srv, cancel)
+			return err
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				store.reload()
+				continue
+			}
+			systemTeardown(srv, cancel)
+			return nil
+		}
+	}
+}
+
+func systemTeardown(srv *http.Server, cancel context.CancelFunc) {
+	logInfof("Shutting down...")
+	// stop polling
+	cancel()
+	// let in-flight scrapes finish
+	ctx, done := context.WithTimeout(context.Background(), shutdownGracePeriod)
+	defer done()
+	if err := srv.Shutdown(ctx); err != nil {
+		logError("shutdown", err, "Metrics server shutdown")
+	}
 }
 
 func main() {
-	e := newEnv(
-		os.Getenv("API_KEY"),
-		getenvInt("MAINTENANCE_ID"),
-		getenvInt("POLL_INTERVAL"),
-		os.Getenv("METRICS_PORT"),
-	)
-	go pollAPI(e)
+	rand.Seed(time.Now().UnixNano())
+	setLogFormat(os.Getenv("LOG_FORMAT"))
+	setLogLevel(os.Getenv("LOG_LEVEL"))
+	metricsPrefix := getenvDefault("METRICS_PREFIX", defaultMetricsPrefix)
+	if !validMetricsPrefix.MatchString(metricsPrefix) {
+		logFatalf("Could not parse env METRICS_PREFIX: %s is not a valid metric name", metricsPrefix)
+	}
+	registerMetrics(metricsPrefix)
+	// env vars override the config file
+	cfg, err := loadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		logFatalf("Could not load env CONFIG_FILE: %s", err)
+	}
+	// flags override env vars
+	// the key is not used as the flag default so it never shows up in -help
+	apiKey := flag.String("api-key", "", "Pingdom API key (env API_KEY)")
+	maintenanceID := flag.String("maintenance-id", intSliceToString(getenvIntListDefault("MAINTENANCE_ID", cfg.MaintenanceIDs)), "Comma separated Pingdom maintenance IDs (env MAINTENANCE_ID)")
+	pollInterval := flag.Int("poll-interval", getenvIntDefault("POLL_INTERVAL", cfg.PollInterval), "Poll interval in seconds (env POLL_INTERVAL)")
+	metricsPort := flag.String("metrics-port", os.Getenv("METRICS_PORT"), "Prometheus metrics port (env METRICS_PORT)")
+	once := flag.Bool("once", getenvBool("RUN_ONCE"), "Reconcile once and exit (env RUN_ONCE)")
+	validate := flag.Bool("validate-config", getenvBool("VALIDATE_CONFIG"), "Check the API key and maintenance IDs without changing anything and exit (env VALIDATE_CONFIG)")
+	showVersion := flag.Bool("version", false, "Print the version and exit")
+	flag.Parse()
+	if *showVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+	apiKeyFile := os.Getenv("API_KEY_FILE")
+	if *apiKey != "" {
+		apiKeyFile = ""
+	} else {
+		*apiKey = getenvDefault("API_KEY", cfg.APIKey)
+	}
+	e := newEnv(EnvOptions{
+		apiKey:              *apiKey,
+		apiKeyFile:          apiKeyFile,
+		maintenanceIDs:      parseIntList(*maintenanceID),
+		pollInterval:        *pollInterval,
+		readyFailures:       getenvInt("READY_FAILURES"),
+		metricsPort:         *metricsPort,
+		metricsUser:         os.Getenv("METRICS_USER"),
+		metricsPassword:     os.Getenv("METRICS_PASSWORD"),
+		tlsCertFile:         os.Getenv("TLS_CERT_FILE"),
+		tlsKeyFile:          os.Getenv("TLS_KEY_FILE"),
+		baseURL:             os.Getenv("API_BASE_URL"),
+		httpTimeout:         getenvInt("HTTP_TIMEOUT"),
+		maxRetries:          getenvInt("MAX_RETRIES"),
+		checkTags:           getenvDefault("CHECK_TAGS", strings.Join(cfg.CheckTags, ",")),
+		excludeTags:         os.Getenv("EXCLUDE_TAGS"),
+		windowFrom:          getenvDefault("WINDOW_FROM", cfg.WindowFrom),
+		windowTo:            getenvDefault("WINDOW_TO", cfg.WindowTo),
+		windowFromDays:      getenvWeekdays("WINDOW_FROM"),
+		windowToDays:        getenvWeekdays("WINDOW_TO"),
+		timezone:            getenvDefault("TIMEZONE", cfg.Timezone),
+		dryRun:              getenvBool("DRY_RUN"),
+		createIfMissing:     getenvBool("CREATE_IF_MISSING"),
+		webhookURL:          os.Getenv("WEBHOOK_URL"),
+		descriptionTemplate: os.Getenv("DESCRIPTION_TEMPLATE"),
+		slackWebhookURL:     os.Getenv("SLACK_WEBHOOK_URL"),
+		recurrenceType:      os.Getenv("RECURRENCE_TYPE"),
+		includeTms:          getenvBoolDefault("INCLUDE_TMS", true),
+		checkTypes:          os.Getenv("CHECK_TYPE"),
+		allowedUpdateHours:  os.Getenv("ALLOWED_UPDATE_HOURS"),
+		accountEmail:        os.Getenv("ACCOUNT_EMAIL"),
+		pollJitter:          getenvBool("POLL_JITTER"),
+		stateFile:           os.Getenv("STATE_FILE"),
+		effectiveToDays:     getenvInt("EFFECTIVE_TO_DAYS"),
+		verifyAfterUpdate:   getenvBool("VERIFY_AFTER_UPDATE"),
+		checkNamePrefix:     os.Getenv("CHECK_NAME_PREFIX"),
+		recheckBeforeUpdate: getenvBool("RECHECK_BEFORE_UPDATE"),
+		proxyURL:            os.Getenv("PINGDOM_PROXY_URL"),
+		insecureSkipVerify:  getenvBool("PINGDOM_INSECURE_SKIP_VERIFY"),
+		maxConcurrency:      getenvInt("MAX_CONCURRENCY"),
+		andTags:             os.Getenv("AND_TAGS"),
+		allowEmpty:          getenvBool("ALLOW_EMPTY"),
+		minChanged:          getenvInt("MIN_CHANGED"),
+		exitOnAuthFailure:   getenvBool("EXIT_ON_AUTH_FAILURE"),
+		userAgent:           os.Getenv("USER_AGENT"),
+		minResolution:       getenvInt("MIN_RESOLUTION"),
+		maxResolution:       getenvInt("MAX_RESOLUTION"),
+		exemptCheckIDs:      os.Getenv("EXEMPT_CHECK_IDS"),
+		leaderElection:      getenvBool("ENABLE_LEADER_ELECTION"),
+		leaderLeaseFile:     os.Getenv("LEADER_LEASE_FILE"),
+		leaderLeaseDuration: getenvInt("LEADER_LEASE_DURATION"),
+		managedByMarker:     getenvMarker("MANAGED_BY_MARKER"),
+		allowActiveUpdate:   getenvBool("ALLOW_ACTIVE_UPDATE"),
+		maintenanceName:     os.Getenv("MAINTENANCE_NAME"),
+		summaryEvery:        getenvInt("SUMMARY_EVERY"),
+	})
+	// listen for signals before starting anything so none are dropped
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	stopTracing := setupTracing()
+	// preflight for deploy pipelines, nothing is updated
+	if *validate {
+		retries := getenvIntDefault("VALIDATE_RETRIES", 3)
+		if retries < 0 {
+			logFatalf("Could not parse env VALIDATE_RETRIES: must be a positive number")
+		}
+		delay := getenvIntDefault("VALIDATE_RETRY_DELAY", 5)
+		if delay <= 0 {
+			logFatalf("Could not parse env VALIDATE_RETRY_DELAY: must be a positive number")
+		}
+		err := validateWithRetries(context.Background(), e, retries, time.Second*time.Duration(delay))
+		stopTracing()
+		if err != nil {
+			logError("validate", err, "Config validation")
+			os.Exit(1)
+		}
+		logInfof("Config valid")
+		os.Exit(0)
+	}
+	// the name lookup needs the api, validate mode retries it with the rest
+	if err := e.resolveName(context.Background()); err != nil {
+		logFatalf("Could not resolve env MAINTENANCE_NAME: %s", err)
+	}
+	// set before the once branch so the metrics a -once run pushes carry them
+	setInfo(e)
+	setBuildInfo()
+	// single reconcile for cron jobs, no metrics server or poll loop
+	if *once {
+		summary := poll(context.Background(), e)
+		// there is no scrape to pick up the metrics of a single run
+		if url := os.Getenv("PUSHGATEWAY_URL"); url != "" {
+			job := getenvDefault("PUSHGATEWAY_JOB", "ps-pingdom-maintenance")
+			err := push.New(url, job).Client(e.notifyClient).Gatherer(prometheus.DefaultGatherer).Push()
+			if err != nil {
+				logError("pushgateway", err, "Push metrics to PUSHGATEWAY_URL")
+			}
+		}
+		stopTracing()
+		if summary.Error != "" {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	store := &EnvStore{env: e}
+	ctx, cancel := context.WithCancel(context.Background())
+	trigger := make(chan chan ReconcileSummary)
+	fatal := make(chan error, 1)
+	go pollAPI(ctx, store, trigger, fatal)
 	// prometheus metrics
-	http.Handle("/metrics", promhttp.Handler())
-	http.ListenAndServe(fmt.Sprintf(":%s", e.metricsPort), nil)
-	mainloop()
+	// OpenMetrics carries the trace id exemplars of the request durations
+	metricsHandler := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+	http.Handle("/metrics", basicAuth(e, metricsHandler))
+	// kubernetes probes
+	http.HandleFunc("/healthz", healthzHandler)
+	http.HandleFunc("/readyz", readyzHandler(e))
+	// manual reconcile
+	http.Handle("/reconcile", basicAuth(e, reconcileHandler(trigger)))
+	// troubleshooting
+	http.Handle("/debug/state", basicAuth(e, debugStateHandler(store)))
+	http.Handle("/checks", basicAuth(e, http.HandlerFunc(checksHandler)))
+	srv := &http.Server{Addr: fmt.Sprintf(":%s", e.metricsPort)}
+	go func() {
+		var err error
+		if e.tlsCertFile != "" {
+			err = srv.ListenAndServeTLS(e.tlsCertFile, e.tlsKeyFile)
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logFatalf("Metrics server: %s", err)
+		}
+	}()
+	err = mainloop(signals, fatal, store, srv, cancel)
+	stopTracing()
+	if err != nil {
+		os.Exit(1)
+	}
 }
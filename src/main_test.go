@@ -0,0 +1,588 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMain(m *testing.M) {
+	registerMetrics(defaultMetricsPrefix)
+	os.Exit(m.Run())
+}
+
+// fixture pingdom api with sla checks 1, 2, the exempt 3 and tms check 5,
+// schedule 11 is missing check 2 and holds the deleted check 9, schedule 12
+// holds the same checks as wanted in another order. PUT bodies are recorded
+// by schedule, failChecks makes the checks request fail
+type fixtureAPI struct {
+	mu         sync.Mutex
+	puts       map[string]MaintenanceScheduleUpdate
+	failChecks bool
+}
+
+func newFixtureAPI(t *testing.T) (*httptest.Server, *fixtureAPI) {
+	t.Helper()
+	f := &fixtureAPI{puts: map[string]MaintenanceScheduleUpdate{}}
+	schedules := map[string]string{
+		"11": `{"maintenance":{"id":11,"description":"nightly","from":1,"to":2,"recurrencetype":"day","repeatevery":1,"effectiveto":4102444800,"checks":{"uptime":[1,9],"tms":[5]}}}`,
+		"12": `{"maintenance":{"id":12,"description":"weekly","from":1,"to":2,"recurrencetype":"week","repeatevery":1,"checks":{"uptime":[2,1],"tms":[5]}}}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == "GET" && r.URL.Path == "/api/3.1/checks":
+			f.mu.Lock()
+			fail := f.failChecks
+			f.mu.Unlock()
+			if fail {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":{"statuscode":400,"statusdesc":"Bad Request","errormessage":"Invalid tags"}}`))
+				return
+			}
+			w.Write([]byte(`{"checks":[
+				{"id":1,"name":"a","type":"http","status":"up","tags":[{"name":"sla"}]},
+				{"id":2,"name":"b","type":"http","status":"down","tags":[{"name":"sla"}]},
+				{"id":3,"name":"c","type":"http","status":"up","tags":[{"name":"sla"}]}
+			],"counts":{"total":3,"limited":3,"filtered":3}}`))
+		case r.Method == "GET" && r.URL.Path == "/api/3.1/tms/check":
+			w.Write([]byte(`{"checks":[{"id":5,"name":"login","active":true,"status":"successful","tags":["sla"]}]}`))
+		case strings.HasPrefix(r.URL.Path, "/api/3.1/maintenance/"):
+			id := strings.TrimPrefix(r.URL.Path, "/api/3.1/maintenance/")
+			if r.Method == "PUT" {
+				var u MaintenanceScheduleUpdate
+				if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+					t.Errorf("PUT maintenance %s: %s", id, err)
+				}
+				f.mu.Lock()
+				f.puts[id] = u
+				f.mu.Unlock()
+				w.Write([]byte(`{"message":"ok"}`))
+				return
+			}
+			body, ok := schedules[id]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error":{"statuscode":404,"statusdesc":"Not Found","errormessage":"Maintenance window not found"}}`))
+				return
+			}
+			w.Write([]byte(body))
+		default:
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, f
+}
+
+// env reconciling the maintenance ids against the api at baseURL, with the
+// defaults newEnv applies
+func testEnv(baseURL string, maintenanceIDs ...int) *Env {
+	return &Env{
+		pingdom:        newTestPingdomClient(baseURL),
+		maintenanceIDs: maintenanceIDs,
+		checkTags:      []string{"sla"},
+		includeTms:     true,
+		location:       time.UTC,
+		windowFrom:     ClockTime{hour: 1},
+		windowTo:       ClockTime{hour: 2},
+		maxConcurrency: 4,
+		minChanged:     1,
+	}
+}
+
+func TestPollCycle(t *testing.T) {
+	srv, api := newFixtureAPI(t)
+	e := testEnv(srv.URL, 11, 12)
+	e.exemptCheckIDs = []int{3}
+
+	from, to := maintenanceWindow(e, time.Now())
+	summary := poll(context.Background(), e)
+	if summary.Error != "" {
+		t.Fatalf("poll failed: %s", summary.Error)
+	}
+	statuses := map[int]string{}
+	for _, r := range summary.Results {
+		statuses[r.MaintenanceID] = r.Status
+	}
+	if statuses[11] != "updated" || statuses[12] != "up_to_date" {
+		t.Errorf("statuses %v, want 11 updated and 12 up_to_date", statuses)
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if len(api.puts) != 1 {
+		t.Fatalf("got PUTs for %d schedules, want only 11", len(api.puts))
+	}
+	put, ok := api.puts["11"]
+	if !ok {
+		t.Fatal("no PUT for schedule 11")
+	}
+	// the window may have rolled over to the next day during the poll
+	if put.From != int(from.Unix()) {
+		from, to = maintenanceWindow(e, time.Now())
+	}
+	tmsIDs := "5"
+	want := MaintenanceScheduleUpdate{
+		Description:    "nightly",
+		From:           int(from.Unix()),
+		To:             int(to.Unix()),
+		Recurrencetype: "day",
+		Repeatevery:    1,
+		Effectiveto:    4102444800,
+		Uptimeids:      "1,2",
+		Tmsids:         &tmsIDs,
+	}
+	got, _ := json.Marshal(put)
+	wantJSON, _ := json.Marshal(want)
+	if string(got) != string(wantJSON) {
+		t.Errorf("PUT %s, want %s", got, wantJSON)
+	}
+	// tagged sla like the others, but exempt
+	if containsInt(parseIntList(put.Uptimeids), 3) {
+		t.Errorf("PUT uptimeids %q hold the exempt check 3", put.Uptimeids)
+	}
+	// the exempt check is filtered before the checks are counted
+	if got := testutil.ToFloat64(slaTotal); got != 2 {
+		t.Errorf("sla_total %v, want 2", got)
+	}
+}
+
+// maintenance schedule holding the uptime and tms ids
+func testSchedule(uptime []int, tms []int) PingdomMaintenanceSchedule {
+	var m PingdomMaintenanceSchedule
+	m.Maintenance.ID = 11
+	m.Maintenance.Checks.Uptime = uptime
+	m.Maintenance.Checks.Tms = tms
+	return m
+}
+
+func TestReorderedScheduleUpToDate(t *testing.T) {
+	m := testSchedule([]int{30, 10, 20}, []int{8, 7})
+	upToDate, got, diff := checkMaintenanceSchedule(m, []int{10, 20, 30}, []int{7, 8}, 1)
+	if !upToDate {
+		t.Fatalf("reordered ids reported out of date: %s", diff)
+	}
+	if len(diff.Added) != 0 || len(diff.Removed) != 0 {
+		t.Errorf("diff %s, want nothing added or removed", diff)
+	}
+	// the schedule is left as pingdom stored it, nothing to send
+	if !reflect.DeepEqual(got.Maintenance.Checks.Uptime, []int{30, 10, 20}) {
+		t.Errorf("uptime ids %v, want the stored order", got.Maintenance.Checks.Uptime)
+	}
+}
+
+func TestChangedScheduleOutOfDate(t *testing.T) {
+	upToDate, got, _ := checkMaintenanceSchedule(testSchedule([]int{1, 2}, nil), []int{2, 3}, nil, 1)
+	if upToDate {
+		t.Fatal("changed ids reported up to date")
+	}
+	if !reflect.DeepEqual(got.Maintenance.Checks.Uptime, []int{2, 3}) {
+		t.Errorf("uptime ids %v, want [2 3]", got.Maintenance.Checks.Uptime)
+	}
+}
+
+func TestRenderDescription(t *testing.T) {
+	date := time.Date(2024, 3, 9, 23, 30, 0, 0, time.UTC)
+	tests := []struct {
+		template string
+		count    int
+		want     string
+	}{
+		{"Managed by ps-pingdom-maintenance", 3, "Managed by ps-pingdom-maintenance"},
+		{"Nightly {date}", 3, "Nightly 2024-03-09"},
+		{"{count} checks", 12, "12 checks"},
+		{"{date}: {count} checks, {count} total", 0, "2024-03-09: 0 checks, 0 total"},
+		{"{unknown}", 1, "{unknown}"},
+	}
+	for _, tt := range tests {
+		if got := renderDescription(tt.template, date, tt.count); got != tt.want {
+			t.Errorf("renderDescription(%q) = %q, want %q", tt.template, got, tt.want)
+		}
+	}
+}
+
+func TestUpdateDescription(t *testing.T) {
+	m := testSchedule([]int{1, 2}, nil)
+	m.Maintenance.Description = "kept as is"
+	e := &Env{location: time.UTC, windowFrom: ClockTime{hour: 1}, windowTo: ClockTime{hour: 2}}
+	if got, _ := newMaintenanceScheduleUpdate(e, m); got.Description != "kept as is" {
+		t.Errorf("description without a template %q, want it unchanged", got.Description)
+	}
+	e.descriptionTemplate = "{count} checks"
+	if got, _ := newMaintenanceScheduleUpdate(e, m); got.Description != "2 checks" {
+		t.Errorf("description %q, want 2 checks", got.Description)
+	}
+}
+
+func TestWithMarker(t *testing.T) {
+	tests := []struct {
+		description, marker, want string
+	}{
+		{"nightly", defaultManagedByMarker, "nightly " + defaultManagedByMarker},
+		{"nightly " + defaultManagedByMarker, defaultManagedByMarker, "nightly " + defaultManagedByMarker},
+		{defaultManagedByMarker + " nightly", defaultManagedByMarker, "nightly " + defaultManagedByMarker},
+		{"", defaultManagedByMarker, defaultManagedByMarker},
+		{"nightly", "", "nightly"},
+	}
+	for _, tt := range tests {
+		got := withMarker(tt.description, tt.marker)
+		if got != tt.want {
+			t.Errorf("withMarker(%q, %q) = %q, want %q", tt.description, tt.marker, got, tt.want)
+		}
+		// applying it again never adds a second marker
+		if again := withMarker(got, tt.marker); again != got {
+			t.Errorf("withMarker twice = %q, want %q", again, got)
+		}
+	}
+}
+
+func TestMarkerIsNotDrift(t *testing.T) {
+	m := testSchedule([]int{1, 2}, nil)
+	m.Maintenance.Description = "nightly " + defaultManagedByMarker
+	upToDate, _, diff := checkMaintenanceSchedule(m, []int{1, 2}, nil, 1)
+	if !upToDate {
+		t.Errorf("schedule with the marker in its description reported out of date: %s", diff)
+	}
+	e := &Env{location: time.UTC, windowFrom: ClockTime{hour: 1}, windowTo: ClockTime{hour: 2}, managedByMarker: defaultManagedByMarker}
+	if got, _ := newMaintenanceScheduleUpdate(e, m); got.Description != m.Maintenance.Description {
+		t.Errorf("description %q, want %q unchanged", got.Description, m.Maintenance.Description)
+	}
+}
+
+func TestGetenvMarker(t *testing.T) {
+	// restored after the test
+	t.Setenv("MANAGED_BY_MARKER", "")
+	os.Unsetenv("MANAGED_BY_MARKER")
+	if got := getenvMarker("MANAGED_BY_MARKER"); got != defaultManagedByMarker {
+		t.Errorf("unset marker %q, want the default", got)
+	}
+	t.Setenv("MANAGED_BY_MARKER", "")
+	if got := getenvMarker("MANAGED_BY_MARKER"); got != "" {
+		t.Errorf("empty marker %q, want it disabled", got)
+	}
+	t.Setenv("MANAGED_BY_MARKER", "[bot]")
+	if got := getenvMarker("MANAGED_BY_MARKER"); got != "[bot]" {
+		t.Errorf("marker %q, want [bot]", got)
+	}
+}
+
+func TestGetUptimeIdsDeduplicates(t *testing.T) {
+	var c PingdomChecks
+	if err := json.Unmarshal([]byte(`{"checks":[{"id":3},{"id":1},{"id":3},{"id":2},{"id":1}]}`), &c); err != nil {
+		t.Fatal(err)
+	}
+	if got := getUptimeIds(c); !reflect.DeepEqual(got, []int{1, 2, 3}) {
+		t.Errorf("getUptimeIds = %v, want [1 2 3]", got)
+	}
+	if got := getUptimeIds(PingdomChecks{}); len(got) != 0 {
+		t.Errorf("getUptimeIds of no checks = %v, want empty", got)
+	}
+	var tc PingdomTmsChecks
+	if err := json.Unmarshal([]byte(`{"checks":[{"id":5},{"id":5}]}`), &tc); err != nil {
+		t.Fatal(err)
+	}
+	if got := getTmsIds(tc); !reflect.DeepEqual(got, []int{5}) {
+		t.Errorf("getTmsIds = %v, want [5]", got)
+	}
+}
+
+func TestWeekdayWindows(t *testing.T) {
+	e := &Env{
+		location:       time.UTC,
+		windowFrom:     ClockTime{hour: 22},
+		windowTo:       ClockTime{hour: 6},
+		windowFromDays: map[time.Weekday]ClockTime{time.Saturday: {hour: 1}},
+		windowToDays:   map[time.Weekday]ClockTime{time.Saturday: {hour: 3, minute: 30}},
+	}
+	tests := []struct {
+		name     string
+		now      time.Time
+		from, to time.Time
+	}{
+		// 2024-03-09 is a saturday, the window stays on the day
+		{"saturday", time.Date(2024, 3, 9, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 9, 1, 0, 0, 0, time.UTC), time.Date(2024, 3, 9, 3, 30, 0, 0, time.UTC)},
+		// 2024-03-12 is a tuesday, the default window rolls over to wednesday
+		{"tuesday", time.Date(2024, 3, 12, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 12, 22, 0, 0, 0, time.UTC), time.Date(2024, 3, 13, 6, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			from, to := maintenanceWindow(e, tt.now)
+			if !from.Equal(tt.from) || !to.Equal(tt.to) {
+				t.Errorf("window %s-%s, want %s-%s", from, to, tt.from, tt.to)
+			}
+		})
+	}
+}
+
+func TestWeekdayWindowInLocation(t *testing.T) {
+	oslo, err := time.LoadLocation("Europe/Oslo")
+	if err != nil {
+		t.Skip("no timezone data")
+	}
+	e := &Env{
+		location:       oslo,
+		windowFrom:     ClockTime{hour: 22},
+		windowTo:       ClockTime{hour: 6},
+		windowFromDays: map[time.Weekday]ClockTime{time.Saturday: {hour: 1}},
+		windowToDays:   map[time.Weekday]ClockTime{time.Saturday: {hour: 3}},
+	}
+	// friday 23:30 UTC is already saturday in oslo
+	from, _ := maintenanceWindow(e, time.Date(2024, 3, 8, 23, 30, 0, 0, time.UTC))
+	if want := time.Date(2024, 3, 9, 1, 0, 0, 0, oslo); !from.Equal(want) {
+		t.Errorf("from %s, want the saturday window %s", from, want)
+	}
+}
+
+func TestParsePort(t *testing.T) {
+	valid := map[string]int{"1": 1, "9600": 9600, "65535": 65535}
+	for s, want := range valid {
+		if got, err := parsePort(s); err != nil || got != want {
+			t.Errorf("parsePort(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"abc", "0", "-1", "65536", "96000", "", "96 00"} {
+		if _, err := parsePort(s); err == nil {
+			t.Errorf("parsePort(%q) accepted an invalid port", s)
+		}
+	}
+}
+
+func TestGaugesKeepValueOnFetchError(t *testing.T) {
+	srv, api := newFixtureAPI(t)
+	e := testEnv(srv.URL, 11)
+	e.exemptCheckIDs = []int{3}
+	if summary := poll(context.Background(), e); summary.Error != "" {
+		t.Fatalf("first poll failed: %s", summary.Error)
+	}
+	if got := testutil.ToFloat64(up); got != 1 {
+		t.Fatalf("up %v after a good poll, want 1", got)
+	}
+	total := testutil.ToFloat64(slaTotal)
+
+	api.mu.Lock()
+	api.failChecks = true
+	api.mu.Unlock()
+	if summary := poll(context.Background(), e); summary.Error == "" {
+		t.Fatal("poll succeeded with the checks request failing")
+	}
+	if got := testutil.ToFloat64(up); got != 0 {
+		t.Errorf("up %v after a failed poll, want 0", got)
+	}
+	if got := testutil.ToFloat64(slaTotal); got != total {
+		t.Errorf("sla_total %v after a failed poll, want the last good %v", got, total)
+	}
+	if got := testutil.ToFloat64(slaMaintenance.WithLabelValues("11")); got != 2 {
+		t.Errorf("sla_maintenance %v after a failed poll, want the last good 2", got)
+	}
+}
+
+func TestDiffIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		a, b    []int
+		added   []int
+		removed []int
+	}{
+		{"equal", []int{1, 2, 3}, []int{1, 2, 3}, []int{}, []int{}},
+		{"reordered", []int{3, 1, 2}, []int{1, 2, 3}, []int{}, []int{}},
+		{"addition", []int{1}, []int{2, 1}, []int{2}, []int{}},
+		{"removal", []int{3, 1, 2}, []int{1}, []int{}, []int{2, 3}},
+		{"both", []int{1, 9}, []int{2, 1}, []int{2}, []int{9}},
+		{"from empty", nil, []int{5, 4}, []int{4, 5}, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed := diffIDs(tt.a, tt.b)
+			if !reflect.DeepEqual(added, tt.added) || !reflect.DeepEqual(removed, tt.removed) {
+				t.Errorf("diffIDs(%v, %v) = %v, %v, want %v, %v", tt.a, tt.b, added, removed, tt.added, tt.removed)
+			}
+		})
+	}
+}
+
+func TestCheckMaintenanceSchedule(t *testing.T) {
+	tests := []struct {
+		name       string
+		uptime     []int
+		tms        []int
+		u, tc      []int
+		minChanged int
+		upToDate   bool
+		want       []int
+		diff       ScheduleDiff
+	}{
+		{"equal", []int{1, 2}, []int{}, []int{1, 2}, []int{}, 1, true, []int{1, 2}, ScheduleDiff{Added: []int{}, Removed: []int{}}},
+		{"reordered but equal", []int{3, 1, 2}, []int{}, []int{1, 2, 3}, []int{}, 1, true, []int{3, 1, 2}, ScheduleDiff{Added: []int{}, Removed: []int{}}},
+		{"addition", []int{1}, []int{}, []int{1, 2}, []int{}, 1, false, []int{1, 2}, ScheduleDiff{Added: []int{2}, Removed: []int{}}},
+		{"removal", []int{1, 2}, []int{}, []int{1}, []int{}, 1, false, []int{1}, ScheduleDiff{Added: []int{}, Removed: []int{2}}},
+		{"tms change", []int{1}, []int{7}, []int{1}, []int{8}, 1, false, []int{1}, ScheduleDiff{Added: []int{8}, Removed: []int{7}}},
+		{"below min changed", []int{1}, []int{}, []int{1, 2}, []int{}, 3, true, []int{1}, ScheduleDiff{Added: []int{2}, Removed: []int{}}},
+		{"at min changed", []int{1, 9}, []int{}, []int{1, 2}, []int{}, 2, false, []int{1, 2}, ScheduleDiff{Added: []int{2}, Removed: []int{9}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upToDate, m, diff := checkMaintenanceSchedule(testSchedule(tt.uptime, tt.tms), tt.u, tt.tc, tt.minChanged)
+			if upToDate != tt.upToDate {
+				t.Errorf("upToDate = %v, want %v", upToDate, tt.upToDate)
+			}
+			if !reflect.DeepEqual(m.Maintenance.Checks.Uptime, tt.want) {
+				t.Errorf("uptime ids %v, want %v", m.Maintenance.Checks.Uptime, tt.want)
+			}
+			if !reflect.DeepEqual(diff, tt.diff) {
+				t.Errorf("diff %s, want %s", diff, tt.diff)
+			}
+		})
+	}
+}
+
+func TestIntSliceToString(t *testing.T) {
+	tests := []struct {
+		in   []int
+		want string
+	}{
+		{nil, ""},
+		{[]int{7}, "7"},
+		{[]int{3, 1, 2}, "1,2,3"},
+		{[]int{10, 9, 100}, "9,10,100"},
+	}
+	for _, tt := range tests {
+		if got := intSliceToString(tt.in); got != tt.want {
+			t.Errorf("intSliceToString(%v) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+	// the input is left in the order it was given
+	in := []int{3, 1, 2}
+	intSliceToString(in)
+	if !reflect.DeepEqual(in, []int{3, 1, 2}) {
+		t.Errorf("input reordered to %v", in)
+	}
+}
+
+func TestTimezoneRoundTrip(t *testing.T) {
+	srv, requests := newFakePingdom(t, http.StatusOK, `{"maintenance":{"id":11,"description":"nightly","recurrencetype":"day","repeatevery":1,"timezone":"Europe/Oslo","checks":{"uptime":[1],"tms":[]}}}`)
+	p := newTestPingdomClient(srv.URL)
+	m, err := p.getPingdomMainenanceSchedule(context.Background(), 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Env{location: time.UTC, windowFrom: ClockTime{hour: 1}, windowTo: ClockTime{hour: 2}}
+	update, err := newMaintenanceScheduleUpdate(e, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.updatePingdomMaintenanceSchedule(context.Background(), 11, update); err != nil {
+		t.Fatal(err)
+	}
+	var sent MaintenanceScheduleUpdate
+	if err := json.Unmarshal([]byte((*requests)[1].body), &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.Timezone != "Europe/Oslo" {
+		t.Errorf("PUT timezone %q, want the Europe/Oslo read back", sent.Timezone)
+	}
+
+	// TIMEZONE wins over the schedule
+	e.scheduleTimezone = "UTC"
+	if got, _ := newMaintenanceScheduleUpdate(e, m); got.Timezone != "UTC" {
+		t.Errorf("timezone %q with TIMEZONE set, want UTC", got.Timezone)
+	}
+	// a schedule without one sends none
+	m.Maintenance.Timezone = ""
+	e.scheduleTimezone = ""
+	if got, _ := newMaintenanceScheduleUpdate(e, m); got.Timezone != "" {
+		t.Errorf("timezone %q, want none", got.Timezone)
+	}
+}
+
+func TestEffectiveToPassedThrough(t *testing.T) {
+	// without EFFECTIVE_TO_DAYS an expired schedule is sent back unchanged
+	srv, requests := newFakePingdom(t, http.StatusOK, `{"message":"ok"}`)
+	m := testSchedule([]int{1}, nil)
+	m.Maintenance.Effectiveto = 946684800
+	e := &Env{location: time.UTC, windowFrom: ClockTime{hour: 1}, windowTo: ClockTime{hour: 2}}
+	update, err := newMaintenanceScheduleUpdate(e, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newTestPingdomClient(srv.URL).updatePingdomMaintenanceSchedule(context.Background(), 11, update); err != nil {
+		t.Fatalf("update with a past effectiveto: %s", err)
+	}
+	var sent MaintenanceScheduleUpdate
+	if err := json.Unmarshal([]byte((*requests)[len(*requests)-1].body), &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.Effectiveto != 946684800 {
+		t.Errorf("PUT effectiveto %d, want the schedule's 946684800", sent.Effectiveto)
+	}
+}
+
+func TestEffectiveToFromDays(t *testing.T) {
+	now := time.Now()
+	m := testSchedule([]int{1}, nil)
+	m.Maintenance.Effectiveto = 946684800
+	e := &Env{location: time.UTC, windowFrom: ClockTime{hour: 1}, windowTo: ClockTime{hour: 2}, effectiveToDays: 30}
+	update, err := newMaintenanceScheduleUpdate(e, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := int(now.AddDate(0, 0, 30).Unix())
+	if update.Effectiveto < want {
+		t.Errorf("effectiveto %d, want 30 days from now", update.Effectiveto)
+	}
+	create, err := newMaintenanceScheduleCreate(e, []int{1}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if create.Effectiveto < want {
+		t.Errorf("create effectiveto %d, want 30 days from now", create.Effectiveto)
+	}
+	// a computed end date that is not in the future is refused
+	if _, err := effectiveToFromDays(now, 0); err == nil || !strings.Contains(err.Error(), "not in the future") {
+		t.Errorf("got %v, want an effectiveto error", err)
+	}
+}
+
+func TestPollAPIAuthFailure(t *testing.T) {
+	srv, _ := newFakePingdom(t, http.StatusUnauthorized, `{"error":{"statuscode":401,"statusdesc":"Unauthorized","errormessage":"Invalid token"}}`)
+	e := newEnv(EnvOptions{
+		apiKey:            "secret",
+		baseURL:           srv.URL,
+		maintenanceIDs:    []int{11},
+		exitOnAuthFailure: true,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	fatal := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		pollAPI(ctx, &EnvStore{env: e}, nil, fatal)
+		close(done)
+	}()
+	select {
+	case err := <-fatal:
+		if !strings.Contains(err.Error(), "Invalid token") {
+			t.Errorf("fatal error %q, want the pingdom message", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("poll loop did not report the rejected key")
+	}
+	// the loop stops itself, main does the exit
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("poll loop kept running after reporting the rejected key")
+	}
+}
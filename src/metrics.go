@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metric names start with this unless METRICS_PREFIX is set
+const defaultMetricsPrefix = "ps_pingdom_maintenance"
+
+// prefixes that make legal prometheus metric names
+var validMetricsPrefix = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+var (
+	up                  prometheus.Gauge
+	slaTotal            prometheus.Gauge
+	slaMaintenance      *prometheus.GaugeVec
+	tmsMaintenance      *prometheus.GaugeVec
+	rateLimitRemaining  *prometheus.GaugeVec
+	dryRunSkipped       prometheus.Counter
+	lastPoll            prometheus.Gauge
+	lastUpdate          prometheus.Gauge
+	apiErrors           *prometheus.CounterVec
+	checkStatus         *prometheus.GaugeVec
+	requestRetries      *prometheus.CounterVec
+	requestDuration     *prometheus.HistogramVec
+	responses           *prometheus.CounterVec
+	pollBackoff         prometheus.Gauge
+	inSync              *prometheus.GaugeVec
+	info                *prometheus.GaugeVec
+	checksAdded         *prometheus.CounterVec
+	checksRemoved       *prometheus.CounterVec
+	panics              prometheus.Counter
+	verifyFailures      *prometheus.CounterVec
+	checksDown          prometheus.Gauge
+	updateSkipped       prometheus.Counter
+	windowFromTimestamp *prometheus.GaugeVec
+	windowToTimestamp   *prometheus.GaugeVec
+	accountChecks       prometheus.Gauge
+	filteredChecks      prometheus.Gauge
+	emptyRefused        *prometheus.CounterVec
+	lastError           *prometheus.GaugeVec
+	isLeader            prometheus.Gauge
+	activeDeferred      *prometheus.CounterVec
+	checkTLSVerify      *prometheus.GaugeVec
+	checkIPv6           *prometheus.GaugeVec
+)
+
+// longest message label of the last error metric
+const maxErrorLabel = 100
+
+// numbers vary between otherwise identical errors, ids, ports, durations
+var errorLabelNumbers = regexp.MustCompile(`[0-9]+`)
+
+// message label for err with numbers collapsed and the length capped, to
+// keep the number of series small
+func errorLabel(err error) string {
+	msg := strings.Join(strings.Fields(err.Error()), " ")
+	msg = errorLabelNumbers.ReplaceAllString(msg, "N")
+	if r := []rune(msg); len(r) > maxErrorLabel {
+		msg = string(r[:maxErrorLabel]) + "..."
+	}
+	return msg
+}
+
+// record the duration of a pingdom request, with the trace id as exemplar
+// when the request was traced
+func observeDuration(ctx context.Context, operation string, seconds float64) {
+	o := requestDuration.WithLabelValues(operation)
+	if id := traceID(ctx); id != "" {
+		if e, ok := o.(prometheus.ExemplarObserver); ok {
+			e.ObserveWithExemplar(seconds, prometheus.Labels{"trace_id": id})
+			return
+		}
+	}
+	o.Observe(seconds)
+}
+
+// expose err as the last error, a nil err clears it
+func setLastError(err error) {
+	lastError.Reset()
+	if err != nil {
+		lastError.WithLabelValues(errorLabel(err)).Set(1)
+	}
+}
+
+// the per check metrics are named like the check status metric, which
+// predates the prefix and keeps its name by default
+func checkMetricName(prefix string, name string) string {
+	if prefix == defaultMetricsPrefix {
+		return "ps_pingdom_check_" + name
+	}
+	return prefix + "_check_" + name
+}
+
+// create the metrics with names starting with prefix and register them, must
+// run before anything records a metric
+func registerMetrics(prefix string) {
+	up = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: prefix + "_up",
+			Help: "Whether the last poll completed without error (1) or failed (0), the other gauges keep their last good value while it is 0",
+		})
+	slaTotal = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: prefix + "_sla_total",
+			Help: "Uptime SLA checks left after the exclude, tag, type, name and resolution filters",
+		})
+	slaMaintenance = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "_sla_maintenance",
+			Help: "The number of SLA checks in the maintenance schedule",
+		}, []string{"maintenance_id"})
+	tmsMaintenance = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "_tms_maintenance",
+			Help: "The number of TMS checks in the maintenance schedule",
+		}, []string{"maintenance_id"})
+	rateLimitRemaining = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "_rate_limit_remaining",
+			Help: "Remaining Pingdom API requests in the current rate limit window",
+		}, []string{"window"})
+	dryRunSkipped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: prefix + "_dryrun_skipped_total",
+			Help: "The number of maintenance schedule updates skipped in dry-run mode",
+		})
+	lastPoll = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: prefix + "_last_poll_timestamp",
+			Help: "Unix time of the last poll that completed without error",
+		})
+	lastUpdate = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: prefix + "_last_update_timestamp",
+			Help: "Unix time of the last successful maintenance schedule update",
+		})
+	apiErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "_api_errors_total",
+			Help: "The number of failed Pingdom API requests",
+		}, []string{"operation"})
+	checkStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: checkMetricName(prefix, "status"),
+			Help: "Current status of each SLA check, up (1), down (0) or paused (-1)",
+		}, []string{"id", "name", "hostname"})
+	requestRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "_retries_total",
+			Help: "The number of retried Pingdom API requests",
+		}, []string{"operation"})
+	requestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    prefix + "_request_duration_seconds",
+			Help:    "Duration of Pingdom API requests",
+			Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+		}, []string{"operation"})
+	responses = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "_responses_total",
+			Help: "The number of Pingdom API responses by status code",
+		}, []string{"operation", "code"})
+	pollBackoff = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: prefix + "_poll_backoff",
+			Help: "The number of consecutive failed polls the poll interval is backing off for",
+		})
+	inSync = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "_in_sync",
+			Help: "Whether the maintenance schedule matched the checks at the last poll (1) or drifted (0)",
+		}, []string{"maintenance_id"})
+	info = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "_info",
+			Help: "Running configuration, always 1",
+		}, []string{"maintenance_id", "poll_interval", "tags"})
+	checksAdded = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "_checks_added_total",
+			Help: "The number of checks added to the maintenance schedule",
+		}, []string{"maintenance_id"})
+	checksRemoved = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "_checks_removed_total",
+			Help: "The number of checks removed from the maintenance schedule",
+		}, []string{"maintenance_id"})
+	panics = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: prefix + "_panics_total",
+			Help: "The number of poll cycles that panicked",
+		})
+	verifyFailures = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "_verify_failures_total",
+			Help: "The number of updates where the stored maintenance schedule did not match what was sent",
+		}, []string{"maintenance_id"})
+	checksDown = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: prefix + "_sla_down",
+			Help: "The number of SLA checks currently down",
+		})
+	updateSkipped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: prefix + "_update_skipped_total",
+			Help: "The number of updates skipped because the maintenance schedule was already up to date when re-checked",
+		})
+	windowFromTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "_window_from_timestamp",
+			Help: "Unix time the maintenance window starts, as stored in Pingdom",
+		}, []string{"maintenance_id"})
+	windowToTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "_window_to_timestamp",
+			Help: "Unix time the maintenance window ends, as stored in Pingdom",
+		}, []string{"maintenance_id"})
+	accountChecks = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: prefix + "_account_checks",
+			Help: "Total uptime checks in the Pingdom account as counted by Pingdom",
+		})
+	filteredChecks = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: prefix + "_filtered_checks",
+			Help: "Uptime checks matching the tags as counted by Pingdom",
+		})
+	emptyRefused = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "_empty_update_refused_total",
+			Help: "The number of updates refused because they would remove every uptime check from the maintenance schedule",
+		}, []string{"maintenance_id"})
+	lastError = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "_last_error",
+			Help: "The error of the last poll with numbers replaced by N, always 1, no series after a successful poll",
+		}, []string{"message"})
+	isLeader = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: prefix + "_is_leader",
+			Help: "Whether this replica updates maintenance schedules (1) or only follows (0), always 1 without leader election",
+		})
+	activeDeferred = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: prefix + "_active_window_deferred_total",
+			Help: "The number of updates deferred because the stored maintenance window was in progress",
+		}, []string{"maintenance_id"})
+	checkTLSVerify = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: checkMetricName(prefix, "tls_verify"),
+			Help: "Whether each http and httpcustom SLA check verifies the TLS certificate (1) or not (0)",
+		}, []string{"id", "name", "hostname"})
+	checkIPv6 = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: checkMetricName(prefix, "ipv6"),
+			Help: "Whether each SLA check tests over IPv6 (1) or IPv4 (0)",
+		}, []string{"id", "name", "hostname"})
+	secondsSinceChange := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: prefix + "_seconds_since_last_change",
+			Help: "Seconds since a maintenance schedule was last changed, or since startup",
+		}, state.secondsSinceChange)
+	buildInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: prefix + "_build_info",
+			Help: "Build metadata of the running binary, always 1",
+		}, []string{"version", "commit", "build_date", "goversion"})
+	prometheus.MustRegister(
+		up,
+		slaTotal,
+		slaMaintenance,
+		tmsMaintenance,
+		rateLimitRemaining,
+		dryRunSkipped,
+		lastPoll,
+		lastUpdate,
+		apiErrors,
+		checkStatus,
+		requestRetries,
+		requestDuration,
+		responses,
+		pollBackoff,
+		inSync,
+		info,
+		checksAdded,
+		checksRemoved,
+		panics,
+		verifyFailures,
+		checksDown,
+		updateSkipped,
+		windowFromTimestamp,
+		windowToTimestamp,
+		accountChecks,
+		filteredChecks,
+		emptyRefused,
+		lastError,
+		isLeader,
+		activeDeferred,
+		checkTLSVerify,
+		checkIPv6,
+		secondsSinceChange,
+		buildInfo,
+	)
+}
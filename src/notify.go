@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WebhookEvent ...
+type WebhookEvent struct {
+	MaintenanceID int   `json:"maintenance_id"`
+	OldUptimeIDs  []int `json:"old_uptime_ids"`
+	NewUptimeIDs  []int `json:"new_uptime_ids"`
+	Timestamp     int64 `json:"timestamp"`
+}
+
+// SlackMessage ...
+type SlackMessage struct {
+	Text string `json:"text"`
+}
+
+// post v as json to url
+func postJSON(e *Env, url string, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := e.notifyClient.Post(url, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Success is indicated with 2xx status codes:
+	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !statusOK {
+		return errors.New("POST responded with status code: " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+// post a maintenance schedule change to the webhook
+func sendWebhook(e *Env, id int, oldIDs []int, newIDs []int) error {
+	return postJSON(e, e.webhookURL, WebhookEvent{
+		MaintenanceID: id,
+		OldUptimeIDs:  oldIDs,
+		NewUptimeIDs:  newIDs,
+		Timestamp:     time.Now().Unix(),
+	})
+}
+
+// format check ids as "name (id)" when the name is known
+func checkList(ids []int, names map[int]string) string {
+	l := []string{}
+	for _, id := range ids {
+		if name, ok := names[id]; ok {
+			l = append(l, fmt.Sprintf("%s (%d)", name, id))
+		} else {
+			l = append(l, strconv.Itoa(id))
+		}
+	}
+	return strings.Join(l, ", ")
+}
+
+// post a summary of added and removed checks to slack
+func sendSlack(e *Env, id int, diff ScheduleDiff, names map[int]string) error {
+	text := fmt.Sprintf("Pingdom maintenance schedule %d updated", id)
+	if len(diff.Added) > 0 {
+		text += "\nAdded: " + checkList(diff.Added, names)
+	}
+	if len(diff.Removed) > 0 {
+		text += "\nRemoved: " + checkList(diff.Removed, names)
+	}
+	return postJSON(e, e.slackWebhookURL, SlackMessage{Text: text})
+}
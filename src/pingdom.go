@@ -0,0 +1,838 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PingdomMaintenanceSchedules ...
+type PingdomMaintenanceSchedules struct {
+	Maintenance []MaintenanceSchedule `json:"maintenance"`
+}
+
+// PingdomMaintenanceSchedule ...
+type PingdomMaintenanceSchedule struct {
+	Maintenance MaintenanceSchedule `json:"maintenance"`
+}
+
+// MaintenanceSchedule ...
+type MaintenanceSchedule struct {
+	ID               int    `json:"id"`
+	Description      string `json:"description"`
+	From             int    `json:"from"`
+	To               int    `json:"to"`
+	Duration         int    `json:"duration"`
+	Durationunit     string `json:"durationunit"`
+	Recurrencetype   string `json:"recurrencetype"`
+	Repeatevery      int    `json:"repeatevery"`
+	Dayofweekinmonth int    `json:"dayofweekinmonth"`
+	Effectiveto      int    `json:"effectiveto"`
+	Timezone         string `json:"timezone,omitempty"`
+	Checks           struct {
+		Uptime []int `json:"uptime"`
+		Tms    []int `json:"tms"`
+	} `json:"checks"`
+}
+
+// number that pingdom may also send quoted or as null
+type looseInt int
+
+func (n *looseInt) UnmarshalJSON(b []byte) error {
+	s := strings.Trim(string(b), `"`)
+	if s == "" || s == "null" {
+		*n = 0
+		return nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return fmt.Errorf("cannot parse %s as a number", b)
+	}
+	*n = looseInt(f)
+	return nil
+}
+
+// decode the numeric fields leniently so a change in their json type does
+// not break every poll
+func (m *MaintenanceSchedule) UnmarshalJSON(b []byte) error {
+	type plain MaintenanceSchedule
+	var raw struct {
+		plain
+		From             looseInt `json:"from"`
+		To               looseInt `json:"to"`
+		Duration         looseInt `json:"duration"`
+		Repeatevery      looseInt `json:"repeatevery"`
+		Dayofweekinmonth looseInt `json:"dayofweekinmonth"`
+		Effectiveto      looseInt `json:"effectiveto"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*m = MaintenanceSchedule(raw.plain)
+	m.From = int(raw.From)
+	m.To = int(raw.To)
+	m.Duration = int(raw.Duration)
+	m.Repeatevery = int(raw.Repeatevery)
+	m.Dayofweekinmonth = int(raw.Dayofweekinmonth)
+	m.Effectiveto = int(raw.Effectiveto)
+	return nil
+}
+
+// MaintenanceScheduleUpdate ...
+type MaintenanceScheduleUpdate struct {
+	Description    string  `json:"description"`
+	From           int     `json:"from"`
+	To             int     `json:"to"`
+	Recurrencetype string  `json:"recurrencetype"`
+	Repeatevery    int     `json:"repeatevery"`
+	Effectiveto    int     `json:"effectiveto"`
+	Uptimeids      string  `json:"uptimeids"`
+	Tmsids         *string `json:"tmsids,omitempty"`
+	Timezone       string  `json:"timezone,omitempty"`
+}
+
+// MaintenanceScheduleCreate ...
+type MaintenanceScheduleCreate struct {
+	Description    string `json:"description"`
+	From           int    `json:"from"`
+	To             int    `json:"to"`
+	Recurrencetype string `json:"recurrencetype,omitempty"`
+	Repeatevery    int    `json:"repeatevery,omitempty"`
+	Effectiveto    int    `json:"effectiveto,omitempty"`
+	Uptimeids      string `json:"uptimeids,omitempty"`
+	Tmsids         string `json:"tmsids,omitempty"`
+	Timezone       string `json:"timezone,omitempty"`
+}
+
+// PingdomChecks ...
+type PingdomChecks struct {
+	Checks []PingdomCheck `json:"checks"`
+	Counts struct {
+		Total    int `json:"total"`
+		Limited  int `json:"limited"`
+		Filtered int `json:"filtered"`
+	} `json:"counts"`
+}
+
+// PingdomCheck ...
+type PingdomCheck struct {
+	ID                int      `json:"id"`
+	Created           int      `json:"created"`
+	Name              string   `json:"name"`
+	Hostname          string   `json:"hostname"`
+	Resolution        int      `json:"resolution"`
+	Type              string   `json:"type"`
+	Ipv6              bool     `json:"ipv6"`
+	VerifyCertificate bool     `json:"verify_certificate"`
+	Lasterrortime     int      `json:"lasterrortime"`
+	Lasttesttime      int      `json:"lasttesttime"`
+	Lastresponsetime  int      `json:"lastresponsetime"`
+	Status            string   `json:"status"`
+	Maintenanceids    []string `json:"maintenanceids,omitempty"`
+	Tags              []struct {
+		Name  string `json:"name"`
+		Type  string `json:"type"`
+		Count int    `json:"count"`
+	} `json:"tags,omitempty"`
+}
+
+// PingdomTmsChecks ...
+type PingdomTmsChecks struct {
+	Checks []PingdomTmsCheck `json:"checks"`
+}
+
+// PingdomTmsCheck ...
+type PingdomTmsCheck struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Active bool     `json:"active"`
+	Status string   `json:"status"`
+	Tags   []string `json:"tags"`
+}
+
+// Doer ...
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// PingdomClient ...
+type PingdomClient struct {
+	apiKey        string
+	baseURL       string
+	client        Doer
+	dryRun        bool
+	maxRetryDelay time.Duration
+	maxRetries    int
+	timeout       time.Duration
+	accountEmail  string
+	userAgent     string
+	// re-fetch the schedule right before updating it
+	recheckBeforeUpdate bool
+}
+
+// returned when a maintenance schedule does not exist
+var errNotFound = errors.New("GET Pingdom maintenance responded with status code: 404")
+
+// ErrUnauthorized is wrapped by errors for requests pingdom rejected the api key for
+var ErrUnauthorized = errors.New("pingdom API key unauthorized")
+
+// returned when an update is skipped because the schedule already has the
+// checks it would set
+var errAlreadyUpToDate = errors.New("maintenance schedule already up to date")
+
+// true if the schedule already has the uptime and tms ids of the update, tms
+// ids are ignored when the update leaves them out
+func scheduleMatches(m PingdomMaintenanceSchedule, schedule MaintenanceScheduleUpdate) bool {
+	if !compareSlice(sortedCopy(m.Maintenance.Checks.Uptime), sortedCopy(parseIntList(schedule.Uptimeids))) {
+		return false
+	}
+	if schedule.Tmsids != nil && !compareSlice(sortedCopy(m.Maintenance.Checks.Tms), sortedCopy(parseIntList(*schedule.Tmsids))) {
+		return false
+	}
+	return true
+}
+
+// longest response body included in status errors
+const maxErrorBody = 512
+
+// PingdomError ...
+type PingdomError struct {
+	Operation    string `json:"-"`
+	StatusCode   int    `json:"statuscode"`
+	StatusDesc   string `json:"statusdesc"`
+	ErrorMessage string `json:"errormessage"`
+}
+
+func (e *PingdomError) Error() string {
+	msg := e.Operation + " responded with status code: " + strconv.Itoa(e.StatusCode)
+	if e.StatusDesc != "" {
+		msg += " " + e.StatusDesc
+	}
+	return msg + ": " + e.ErrorMessage
+}
+
+// parse the error payload pingdom sends with non-2xx responses
+func parsePingdomError(operation string, statusCode int, body []byte) *PingdomError {
+	var payload struct {
+		Error *PingdomError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil || payload.Error == nil || payload.Error.ErrorMessage == "" {
+		return nil
+	}
+	payload.Error.Operation = operation
+	if payload.Error.StatusCode == 0 {
+		payload.Error.StatusCode = statusCode
+	}
+	return payload.Error
+}
+
+// error for a non-2xx response, wrapping ErrUnauthorized when the api key
+// was rejected
+func statusError(prefix string, resp *http.Response) error {
+	err := responseError(prefix, resp)
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w: %w", ErrUnauthorized, err)
+	}
+	return err
+}
+
+// error for a non-2xx response, using pingdom's error payload when present
+// and otherwise the start of the response body
+func responseError(prefix string, resp *http.Response) error {
+	msg := prefix + " responded with status code: " + strconv.Itoa(resp.StatusCode)
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody+1))
+	if err != nil || len(body) == 0 {
+		return errors.New(msg)
+	}
+	if perr := parsePingdomError(prefix, resp.StatusCode, body); perr != nil {
+		return perr
+	}
+	truncated := len(body) > maxErrorBody
+	if truncated {
+		body = body[:maxErrorBody]
+	}
+	text := strings.TrimSpace(string(body))
+	if truncated {
+		text += "..."
+	}
+	return errors.New(msg + ": " + text)
+}
+
+// identify the client and scope the request to another account of a
+// multi-user setup when configured
+func (p *PingdomClient) addHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", p.userAgent)
+	if p.accountEmail != "" {
+		req.Header.Add("Account-Email", p.accountEmail)
+	}
+}
+
+// number of checks requested per page
+const checksPageLimit = 250
+
+// fallback delay when a 429 carries no usable retry header
+const rateLimitDelay = 10 * time.Second
+
+// initial delay before retrying a failed request, doubled on every attempt
+const retryBackoff = time.Second
+
+// PingdomOptions ...
+type PingdomOptions struct {
+	apiKey  string
+	baseURL string
+	// nil uses HTTPS_PROXY and NO_PROXY
+	proxy               *url.URL
+	insecureSkipVerify  bool
+	dryRun              bool
+	maxRetryDelay       time.Duration
+	maxRetries          int
+	timeout             time.Duration
+	accountEmail        string
+	recheckBeforeUpdate bool
+	userAgent           string
+}
+
+// pingdom api client with its own transport, so its proxy and tls settings
+// only apply to pingdom
+func newPingdomClient(o PingdomOptions) *PingdomClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	if o.proxy != nil {
+		transport.Proxy = http.ProxyURL(o.proxy)
+	}
+	if o.insecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &PingdomClient{
+		apiKey:  o.apiKey,
+		baseURL: o.baseURL,
+		client: &http.Client{
+			Timeout:   o.timeout,
+			Transport: transport,
+		},
+		dryRun:              o.dryRun,
+		maxRetryDelay:       o.maxRetryDelay,
+		maxRetries:          o.maxRetries,
+		timeout:             o.timeout,
+		accountEmail:        o.accountEmail,
+		recheckBeforeUpdate: o.recheckBeforeUpdate,
+		userAgent:           o.userAgent,
+	}
+}
+
+// build the tags query parameter, escaping each tag individually
+func tagsQuery(tags []string) string {
+	escaped := []string{}
+	for _, t := range tags {
+		escaped = append(escaped, url.QueryEscape(t))
+	}
+	return "tags=" + strings.Join(escaped, ",")
+}
+
+// get a list of pingdom checks matching the tags, following pagination until
+// a short page or until all checks matching the tags are fetched. With tags
+// set the total counts every check on the account, so only the filtered
+// count says when to stop
+func (p *PingdomClient) getPingdomChecks(ctx context.Context, tags []string) (PingdomChecks, error) {
+	var c = PingdomChecks{}
+	for {
+		page, err := p.getPingdomChecksPage(ctx, tags, len(c.Checks))
+		if err != nil {
+			return PingdomChecks{}, err
+		}
+		c.Checks = append(c.Checks, page.Checks...)
+		c.Counts = page.Counts
+		want := page.Counts.Total
+		if len(tags) > 0 {
+			want = page.Counts.Filtered
+		}
+		if len(page.Checks) < checksPageLimit || (want > 0 && len(c.Checks) >= want) {
+			break
+		}
+	}
+	accountChecks.Set(float64(c.Counts.Total))
+	filteredChecks.Set(float64(c.Counts.Filtered))
+	// pingdom limited the response to fewer checks than matched the tags
+	if c.Counts.Limited > 0 && len(c.Checks) < c.Counts.Filtered {
+		logWarnf("Pingdom returned %d of %d checks matching the tags", len(c.Checks), c.Counts.Filtered)
+	}
+	return c, nil
+}
+
+// status values for the check status metric
+var checkStatusValues = map[string]float64{
+	"up":               1,
+	"down":             0,
+	"unconfirmed_down": 0,
+	"paused":           -1,
+}
+
+// check types with a verify_certificate setting
+var tlsCheckTypes = map[string]bool{
+	"http":       true,
+	"httpcustom": true,
+}
+
+// 1 for true and 0 for false
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// set the check status metrics, checks in an unknown state are left out.
+// Checks that are down may be failing for real behind the maintenance window
+// so they are logged too
+func recordCheckStatus(c PingdomChecks) {
+	checkStatus.Reset()
+	checkTLSVerify.Reset()
+	checkIPv6.Reset()
+	down := []string{}
+	for _, check := range c.Checks {
+		if v, ok := checkStatusValues[check.Status]; ok {
+			checkStatus.WithLabelValues(strconv.Itoa(check.ID), check.Name, check.Hostname).Set(v)
+		}
+		// only http checks have a certificate to verify
+		if tlsCheckTypes[check.Type] {
+			checkTLSVerify.WithLabelValues(strconv.Itoa(check.ID), check.Name, check.Hostname).Set(boolValue(check.VerifyCertificate))
+		}
+		checkIPv6.WithLabelValues(strconv.Itoa(check.ID), check.Name, check.Hostname).Set(boolValue(check.Ipv6))
+		if check.Status == "down" {
+			down = append(down, check.Name)
+		}
+	}
+	checksDown.Set(float64(len(down)))
+	if len(down) > 0 {
+		logWarnf("SLA checks down: %s", strings.Join(down, ", "))
+	}
+}
+
+// get a single page of pingdom checks matching the tags
+func (p *PingdomClient) getPingdomChecksPage(ctx context.Context, tags []string, offset int) (PingdomChecks, error) {
+	u := fmt.Sprintf(`%s/api/3.1/checks?%s&include_tags=true&limit=%d&offset=%d`, p.baseURL, tagsQuery(tags), checksPageLimit, offset)
+	var bearer = "Bearer " + p.apiKey
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		apiErrors.WithLabelValues("get_checks").Inc()
+		return PingdomChecks{}, err
+	}
+	req.Header.Add("Authorization", bearer)
+	p.addHeaders(req)
+	resp, err := p.doRequest("get_checks", req)
+	if err != nil {
+		apiErrors.WithLabelValues("get_checks").Inc()
+		return PingdomChecks{}, err
+	}
+	defer resp.Body.Close()
+	// Success is indicated with 2xx status codes:
+	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !statusOK {
+		apiErrors.WithLabelValues("get_checks").Inc()
+		return PingdomChecks{}, statusError("GET Pingdom checks", resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		apiErrors.WithLabelValues("get_checks").Inc()
+		return PingdomChecks{}, err
+	}
+	var c = PingdomChecks{}
+	err = json.Unmarshal(body, &c)
+	if err != nil {
+		apiErrors.WithLabelValues("get_checks").Inc()
+		return PingdomChecks{}, err
+	}
+	return c, nil
+}
+
+// get a list of pingdom transaction checks matching the tags
+func (p *PingdomClient) getPingdomTmsChecks(ctx context.Context, tags []string) (PingdomTmsChecks, error) {
+	u := p.baseURL + `/api/3.1/tms/check?` + tagsQuery(tags)
+	var bearer = "Bearer " + p.apiKey
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		apiErrors.WithLabelValues("get_tms_checks").Inc()
+		return PingdomTmsChecks{}, err
+	}
+	req.Header.Add("Authorization", bearer)
+	p.addHeaders(req)
+	resp, err := p.doRequest("get_tms_checks", req)
+	if err != nil {
+		apiErrors.WithLabelValues("get_tms_checks").Inc()
+		return PingdomTmsChecks{}, err
+	}
+	defer resp.Body.Close()
+	// Success is indicated with 2xx status codes:
+	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !statusOK {
+		apiErrors.WithLabelValues("get_tms_checks").Inc()
+		return PingdomTmsChecks{}, statusError("GET Pingdom TMS checks", resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		apiErrors.WithLabelValues("get_tms_checks").Inc()
+		return PingdomTmsChecks{}, err
+	}
+	var c = PingdomTmsChecks{}
+	err = json.Unmarshal(body, &c)
+	if err != nil {
+		apiErrors.WithLabelValues("get_tms_checks").Inc()
+		return PingdomTmsChecks{}, err
+	}
+	return c, nil
+}
+
+// Get pingdom maintenance schedule by id
+func (p *PingdomClient) getPingdomMainenanceSchedule(ctx context.Context, id int) (PingdomMaintenanceSchedule, error) {
+	url := fmt.Sprintf(`%s/api/3.1/maintenance/%d`, p.baseURL, id)
+	var bearer = "Bearer " + p.apiKey
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		apiErrors.WithLabelValues("get_maintenance").Inc()
+		return PingdomMaintenanceSchedule{}, err
+	}
+	req.Header.Add("Authorization", bearer)
+	p.addHeaders(req)
+	resp, err := p.doRequest("get_maintenance", req)
+	if err != nil {
+		apiErrors.WithLabelValues("get_maintenance").Inc()
+		return PingdomMaintenanceSchedule{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		apiErrors.WithLabelValues("get_maintenance").Inc()
+		return PingdomMaintenanceSchedule{}, errNotFound
+	}
+	// Success is indicated with 2xx status codes:
+	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !statusOK {
+		apiErrors.WithLabelValues("get_maintenance").Inc()
+		return PingdomMaintenanceSchedule{}, statusError("GET Pingdom maintenance", resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		apiErrors.WithLabelValues("get_maintenance").Inc()
+		return PingdomMaintenanceSchedule{}, err
+	}
+	var m = PingdomMaintenanceSchedule{}
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		apiErrors.WithLabelValues("get_maintenance").Inc()
+		logDebugf("Pingdom maintenance %d response: %s", id, body)
+		return PingdomMaintenanceSchedule{}, fmt.Errorf("decode Pingdom maintenance %d: %w", id, err)
+	}
+	slaMaintenance.WithLabelValues(strconv.Itoa(id)).Set(float64(len(m.Maintenance.Checks.Uptime)))
+	tmsMaintenance.WithLabelValues(strconv.Itoa(id)).Set(float64(len(m.Maintenance.Checks.Tms)))
+	windowFromTimestamp.WithLabelValues(strconv.Itoa(id)).Set(float64(m.Maintenance.From))
+	windowToTimestamp.WithLabelValues(strconv.Itoa(id)).Set(float64(m.Maintenance.To))
+	return m, nil
+}
+
+// Get all pingdom maintenance schedules
+func (p *PingdomClient) getPingdomMaintenanceSchedules(ctx context.Context) (PingdomMaintenanceSchedules, error) {
+	url := p.baseURL + `/api/3.1/maintenance`
+	var bearer = "Bearer " + p.apiKey
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		apiErrors.WithLabelValues("list_maintenance").Inc()
+		return PingdomMaintenanceSchedules{}, err
+	}
+	req.Header.Add("Authorization", bearer)
+	p.addHeaders(req)
+	resp, err := p.doRequest("list_maintenance", req)
+	if err != nil {
+		apiErrors.WithLabelValues("list_maintenance").Inc()
+		return PingdomMaintenanceSchedules{}, err
+	}
+	defer resp.Body.Close()
+	// Success is indicated with 2xx status codes:
+	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !statusOK {
+		apiErrors.WithLabelValues("list_maintenance").Inc()
+		return PingdomMaintenanceSchedules{}, statusError("GET Pingdom maintenance list", resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		apiErrors.WithLabelValues("list_maintenance").Inc()
+		return PingdomMaintenanceSchedules{}, err
+	}
+	var m = PingdomMaintenanceSchedules{}
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		apiErrors.WithLabelValues("list_maintenance").Inc()
+		logDebugf("Pingdom maintenance list response: %s", body)
+		return PingdomMaintenanceSchedules{}, fmt.Errorf("decode Pingdom maintenance list: %w", err)
+	}
+	return m, nil
+}
+
+// Update pingdom maintenance schedule
+func (p *PingdomClient) updatePingdomMaintenanceSchedule(ctx context.Context, id int, schedule MaintenanceScheduleUpdate) error {
+	// refuse to send an empty or negative window
+	if schedule.From >= schedule.To {
+		return fmt.Errorf("invalid maintenance window for %d: from %s is not before to %s", id,
+			time.Unix(int64(schedule.From), 0).UTC().Format(time.RFC3339),
+			time.Unix(int64(schedule.To), 0).UTC().Format(time.RFC3339))
+	}
+	url := fmt.Sprintf(`%s/api/3.1/maintenance/%d`, p.baseURL, id)
+	var bearer = "Bearer " + p.apiKey
+	// marshal MaintenanceScheduleUpdate to json
+	json, err := json.Marshal(schedule)
+	if err != nil {
+		apiErrors.WithLabelValues("update_maintenance").Inc()
+		return err
+	}
+	// another replica may have updated the schedule since it was fetched
+	if p.recheckBeforeUpdate {
+		current, err := p.getPingdomMainenanceSchedule(ctx, id)
+		if err != nil {
+			return err
+		}
+		if scheduleMatches(current, schedule) {
+			updateSkipped.Inc()
+			return errAlreadyUpToDate
+		}
+	}
+	if p.dryRun {
+		logInfof("[DRY-RUN] PUT %s: %s", url, json)
+		dryRunSkipped.Inc()
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, bytes.NewBuffer(json))
+	if err != nil {
+		apiErrors.WithLabelValues("update_maintenance").Inc()
+		return err
+	}
+	req.Header.Add("Authorization", bearer)
+	p.addHeaders(req)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.doRequest("update_maintenance", req)
+	if err != nil {
+		apiErrors.WithLabelValues("update_maintenance").Inc()
+		return err
+	}
+	defer resp.Body.Close()
+	// Success is indicated with 2xx status codes:
+	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !statusOK {
+		apiErrors.WithLabelValues("update_maintenance").Inc()
+		return statusError("UPDATE Pingdom maintenance", resp)
+	}
+	response, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		apiErrors.WithLabelValues("update_maintenance").Inc()
+		return err
+	}
+	logDebugf("PUT: %s", json)
+	logDebugf("RESPONSE: %s", response)
+	lastUpdate.SetToCurrentTime()
+	return nil
+}
+
+// Create pingdom maintenance schedule, returns the new id
+func (p *PingdomClient) createPingdomMaintenanceSchedule(ctx context.Context, schedule MaintenanceScheduleCreate) (int, error) {
+	url := p.baseURL + `/api/3.1/maintenance`
+	var bearer = "Bearer " + p.apiKey
+	// marshal MaintenanceScheduleCreate to json
+	payload, err := json.Marshal(schedule)
+	if err != nil {
+		apiErrors.WithLabelValues("create_maintenance").Inc()
+		return 0, err
+	}
+	if p.dryRun {
+		logInfof("[DRY-RUN] POST %s: %s", url, payload)
+		dryRunSkipped.Inc()
+		return 0, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payload))
+	if err != nil {
+		apiErrors.WithLabelValues("create_maintenance").Inc()
+		return 0, err
+	}
+	req.Header.Add("Authorization", bearer)
+	p.addHeaders(req)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.doRequest("create_maintenance", req)
+	if err != nil {
+		apiErrors.WithLabelValues("create_maintenance").Inc()
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Success is indicated with 2xx status codes:
+	statusOK := resp.StatusCode >= 200 && resp.StatusCode < 300
+	if !statusOK {
+		apiErrors.WithLabelValues("create_maintenance").Inc()
+		return 0, statusError("CREATE Pingdom maintenance", resp)
+	}
+	response, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		apiErrors.WithLabelValues("create_maintenance").Inc()
+		return 0, err
+	}
+	logDebugf("POST: %s", payload)
+	logDebugf("RESPONSE: %s", response)
+	var m = PingdomMaintenanceSchedule{}
+	err = json.Unmarshal(response, &m)
+	if err != nil {
+		apiErrors.WithLabelValues("create_maintenance").Inc()
+		return 0, err
+	}
+	lastUpdate.SetToCurrentTime()
+	return m.Maintenance.ID, nil
+}
+
+// parse a Pingdom Req-Limit-* header, e.g. "Remaining: 394 Time until reset: 3589"
+func parseRateLimit(h string) (remaining int, reset int, ok bool) {
+	_, err := fmt.Sscanf(h, "Remaining: %d Time until reset: %d", &remaining, &reset)
+	return remaining, reset, err == nil
+}
+
+// work out how long to wait before retrying a rate limited request
+func (p *PingdomClient) retryDelay(h http.Header) time.Duration {
+	d := rateLimitDelay
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil {
+			d = time.Second * time.Duration(secs)
+		} else if t, err := http.ParseTime(v); err == nil {
+			d = time.Until(t)
+		}
+	} else {
+		for _, k := range []string{"Req-Limit-Short", "Req-Limit-Long"} {
+			if remaining, reset, ok := parseRateLimit(h.Get(k)); ok && remaining == 0 {
+				d = time.Second * time.Duration(reset)
+				break
+			}
+		}
+	}
+	if p.maxRetryDelay > 0 && d > p.maxRetryDelay {
+		d = p.maxRetryDelay
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// record the remaining request budget from the rate limit headers
+func recordRateLimit(h http.Header) {
+	if remaining, _, ok := parseRateLimit(h.Get("Req-Limit-Short")); ok {
+		rateLimitRemaining.WithLabelValues("short").Set(float64(remaining))
+	}
+	if remaining, _, ok := parseRateLimit(h.Get("Req-Limit-Long")); ok {
+		rateLimitRemaining.WithLabelValues("long").Set(float64(remaining))
+	}
+}
+
+// response body that releases the request context when closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// send a request with a timeout and record how long it took
+func (p *PingdomClient) timedDo(operation string, req *http.Request) (*http.Response, error) {
+	ctx, endSpan := startSpan(req.Context(), "pingdom."+operation)
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	start := time.Now()
+	resp, err := p.client.Do(req.WithContext(ctx))
+	observeDuration(ctx, operation, time.Since(start).Seconds())
+	if err != nil {
+		endSpan(0, err)
+		cancel()
+		return nil, err
+	}
+	endSpan(resp.StatusCode, nil)
+	responses.WithLabelValues(operation, strconv.Itoa(resp.StatusCode)).Inc()
+	resp.Body = cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// sleep for d, returning early with an error if ctx is cancelled
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// rewind the request body so the request can be sent again
+func rewindBody(req *http.Request) error {
+	if req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
+
+// send a request to pingdom, retrying once if we are rate limited and with
+// exponential backoff on network errors and 5xx responses
+func (p *PingdomClient) doRequest(operation string, req *http.Request) (*http.Response, error) {
+	rateLimited := false
+	retries := 0
+	backoff := retryBackoff
+	for {
+		resp, err := p.timedDo(operation, req)
+		if err == nil {
+			recordRateLimit(resp.Header)
+		}
+		// never retry once the caller has given up
+		if ctxErr := req.Context().Err(); ctxErr != nil {
+			if err == nil {
+				resp.Body.Close()
+			}
+			return nil, ctxErr
+		}
+		switch {
+		case err == nil && resp.StatusCode == http.StatusTooManyRequests && !rateLimited:
+			rateLimited = true
+			resp.Body.Close()
+			d := p.retryDelay(resp.Header)
+			logWarnf("Pingdom rate limit hit: retrying %s %s in %s", req.Method, req.URL.Path, d)
+			if err := sleepContext(req.Context(), d); err != nil {
+				return nil, err
+			}
+		// a POST may have gone through before failing, retrying it could
+		// create a duplicate schedule
+		case (err != nil || resp.StatusCode >= 500) && retries < p.maxRetries && req.Method != http.MethodPost:
+			if err == nil {
+				resp.Body.Close()
+			}
+			retries++
+			requestRetries.WithLabelValues(operation).Inc()
+			logWarnf("Pingdom %s %s failed: retrying in %s (%d/%d)", req.Method, req.URL.Path, backoff, retries, p.maxRetries)
+			if err := sleepContext(req.Context(), backoff); err != nil {
+				return nil, err
+			}
+			backoff *= 2
+		default:
+			return resp, err
+		}
+		if err := rewindBody(req); err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// a recorded request to the fake pingdom api
+type recordedRequest struct {
+	method string
+	path   string
+	query  string
+	header http.Header
+	body   string
+}
+
+// fake pingdom api replying with status and body to every request, the
+// requests are recorded in order
+func newFakePingdom(t *testing.T, status int, body string) (*httptest.Server, *[]recordedRequest) {
+	t.Helper()
+	requests := []recordedRequest{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, recordedRequest{
+			method: r.Method,
+			path:   r.URL.Path,
+			query:  r.URL.RawQuery,
+			header: r.Header.Clone(),
+			body:   string(b),
+		})
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+// pingdom client for the fake api
+func newTestPingdomClient(baseURL string) *PingdomClient {
+	return newPingdomClient(PingdomOptions{
+		apiKey:        "secret",
+		baseURL:       baseURL,
+		maxRetryDelay: time.Second,
+		timeout:       5 * time.Second,
+		accountEmail:  "ops@example.com",
+		userAgent:     "ps-pingdom-maintenance/test",
+	})
+}
+
+// a valid update for maintenance schedule 11
+func testUpdate() MaintenanceScheduleUpdate {
+	now := time.Now()
+	return MaintenanceScheduleUpdate{
+		Description:    "nightly",
+		From:           int(now.Add(time.Hour).Unix()),
+		To:             int(now.Add(2 * time.Hour).Unix()),
+		Recurrencetype: "day",
+		Repeatevery:    1,
+		Uptimeids:      "1,2",
+	}
+}
+
+func TestPingdomRequests(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		call   func(p *PingdomClient) error
+		method string
+		path   string
+		query  string
+	}{
+		{
+			name: "checks",
+			body: `{"checks":[{"id":1}],"counts":{"total":1,"limited":1,"filtered":1}}`,
+			call: func(p *PingdomClient) error {
+				_, err := p.getPingdomChecks(context.Background(), []string{"sla", "a b"})
+				return err
+			},
+			method: "GET",
+			path:   "/api/3.1/checks",
+			query:  "tags=sla,a+b&include_tags=true&limit=250&offset=0",
+		},
+		{
+			name: "tms checks",
+			body: `{"checks":[]}`,
+			call: func(p *PingdomClient) error {
+				_, err := p.getPingdomTmsChecks(context.Background(), []string{"sla"})
+				return err
+			},
+			method: "GET",
+			path:   "/api/3.1/tms/check",
+			query:  "tags=sla",
+		},
+		{
+			name: "maintenance",
+			body: `{"maintenance":{"id":11}}`,
+			call: func(p *PingdomClient) error {
+				_, err := p.getPingdomMainenanceSchedule(context.Background(), 11)
+				return err
+			},
+			method: "GET",
+			path:   "/api/3.1/maintenance/11",
+		},
+		{
+			name: "maintenance list",
+			body: `{"maintenance":[{"id":11}]}`,
+			call: func(p *PingdomClient) error {
+				_, err := p.getPingdomMaintenanceSchedules(context.Background())
+				return err
+			},
+			method: "GET",
+			path:   "/api/3.1/maintenance",
+		},
+		{
+			name: "update",
+			body: `{"message":"ok"}`,
+			call: func(p *PingdomClient) error {
+				return p.updatePingdomMaintenanceSchedule(context.Background(), 11, testUpdate())
+			},
+			method: "PUT",
+			path:   "/api/3.1/maintenance/11",
+		},
+		{
+			name: "create",
+			body: `{"maintenance":{"id":12}}`,
+			call: func(p *PingdomClient) error {
+				_, err := p.createPingdomMaintenanceSchedule(context.Background(), MaintenanceScheduleCreate{Description: "new", From: 1, To: 2})
+				return err
+			},
+			method: "POST",
+			path:   "/api/3.1/maintenance",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := newFakePingdom(t, http.StatusOK, tt.body)
+			if err := tt.call(newTestPingdomClient(srv.URL)); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(*requests) != 1 {
+				t.Fatalf("got %d requests, want 1", len(*requests))
+			}
+			r := (*requests)[0]
+			if r.method != tt.method || r.path != tt.path || r.query != tt.query {
+				t.Errorf("got %s %s?%s, want %s %s?%s", r.method, r.path, r.query, tt.method, tt.path, tt.query)
+			}
+			if got := r.header.Get("Authorization"); got != "Bearer secret" {
+				t.Errorf("Authorization = %q", got)
+			}
+			if got := r.header.Get("User-Agent"); got != "ps-pingdom-maintenance/test" {
+				t.Errorf("User-Agent = %q", got)
+			}
+			if got := r.header.Get("Account-Email"); got != "ops@example.com" {
+				t.Errorf("Account-Email = %q", got)
+			}
+			if r.method != "GET" && r.header.Get("Content-Type") != "application/json" {
+				t.Errorf("Content-Type = %q", r.header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+func TestPingdomStatusErrors(t *testing.T) {
+	for _, status := range []int{http.StatusUnauthorized, http.StatusNotFound, http.StatusInternalServerError} {
+		srv, _ := newFakePingdom(t, status, `{}`)
+		p := newTestPingdomClient(srv.URL)
+		calls := map[string]error{}
+		_, calls["checks"] = p.getPingdomChecks(context.Background(), []string{"sla"})
+		_, calls["tms checks"] = p.getPingdomTmsChecks(context.Background(), []string{"sla"})
+		_, calls["maintenance"] = p.getPingdomMainenanceSchedule(context.Background(), 11)
+		_, calls["maintenance list"] = p.getPingdomMaintenanceSchedules(context.Background())
+		calls["update"] = p.updatePingdomMaintenanceSchedule(context.Background(), 11, testUpdate())
+		_, calls["create"] = p.createPingdomMaintenanceSchedule(context.Background(), MaintenanceScheduleCreate{Description: "new", From: 1, To: 2})
+		for name, err := range calls {
+			if err == nil || !strings.Contains(err.Error(), "status code: "+strconv.Itoa(status)) {
+				t.Errorf("%s with status %d: got %v, want a status error", name, status, err)
+			}
+		}
+		// a missing schedule is told apart so it can be created
+		if (calls["maintenance"] == errNotFound) != (status == http.StatusNotFound) {
+			t.Errorf("maintenance with status %d: got %v", status, calls["maintenance"])
+		}
+	}
+}
+
+func TestPingdomStatusErrorBody(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{"reply", " bad things\n", "GET Pingdom maintenance responded with status code: 400: bad things"},
+		{"empty reply", "", "GET Pingdom maintenance responded with status code: 400"},
+		{"long reply", strings.Repeat("x", maxErrorBody+1), "GET Pingdom maintenance responded with status code: 400: " + strings.Repeat("x", maxErrorBody) + "..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := newFakePingdom(t, http.StatusBadRequest, tt.body)
+			_, err := newTestPingdomClient(srv.URL).getPingdomMainenanceSchedule(context.Background(), 11)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestPingdomUnauthorized(t *testing.T) {
+	tests := []struct {
+		status       int
+		body         string
+		unauthorized bool
+	}{
+		{http.StatusUnauthorized, `{"error":{"statuscode":401,"statusdesc":"Unauthorized","errormessage":"Invalid token"}}`, true},
+		{http.StatusForbidden, `{"error":{"statuscode":403,"statusdesc":"Forbidden","errormessage":"No access"}}`, true},
+		{http.StatusBadRequest, `{"error":{"statuscode":400,"statusdesc":"Bad Request","errormessage":"Invalid parameter"}}`, false},
+		{http.StatusInternalServerError, `{"error":{"statuscode":500,"statusdesc":"Internal Server Error","errormessage":"Oops"}}`, false},
+	}
+	for _, tt := range tests {
+		srv, _ := newFakePingdom(t, tt.status, tt.body)
+		err := newTestPingdomClient(srv.URL).updatePingdomMaintenanceSchedule(context.Background(), 11, testUpdate())
+		if errors.Is(err, ErrUnauthorized) != tt.unauthorized {
+			t.Errorf("status %d: errors.Is(%v, ErrUnauthorized) = %v, want %v", tt.status, err, !tt.unauthorized, tt.unauthorized)
+		}
+		// the pingdom error stays reachable behind the wrap
+		var perr *PingdomError
+		if !errors.As(err, &perr) || perr.StatusCode != tt.status {
+			t.Errorf("status %d: got %v, want a *PingdomError", tt.status, err)
+		}
+	}
+}
+
+func TestPingdomRetries(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name string
+		call func(p *PingdomClient) error
+		want int
+	}{
+		{
+			name: "get is retried",
+			call: func(p *PingdomClient) error {
+				_, err := p.getPingdomMainenanceSchedule(ctx, 11)
+				return err
+			},
+			want: 2,
+		},
+		{
+			name: "put is retried",
+			call: func(p *PingdomClient) error {
+				return p.updatePingdomMaintenanceSchedule(ctx, 11, testUpdate())
+			},
+			want: 2,
+		},
+		{
+			name: "post is not retried",
+			call: func(p *PingdomClient) error {
+				_, err := p.createPingdomMaintenanceSchedule(ctx, MaintenanceScheduleCreate{Description: "new", From: 1, To: 2})
+				return err
+			},
+			want: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := newFakePingdom(t, http.StatusBadGateway, "")
+			p := newTestPingdomClient(srv.URL)
+			p.maxRetries = 1
+			if err := tt.call(p); err == nil {
+				t.Fatal("expected an error")
+			}
+			if len(*requests) != tt.want {
+				t.Errorf("got %d requests, want %d", len(*requests), tt.want)
+			}
+		})
+	}
+}
+
+// Doer failing every request
+type failingDoer struct{}
+
+func (failingDoer) Do(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestPingdomInjectedClient(t *testing.T) {
+	p := newTestPingdomClient("http://pingdom.invalid")
+	p.client = failingDoer{}
+	if _, err := p.getPingdomChecks(context.Background(), []string{"sla"}); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("got %v, want the error of the injected client", err)
+	}
+}
+
+// fake pingdom api serving n checks in pages of the requested limit, total
+// and filtered are returned as the counts
+func newPaginatedPingdom(t *testing.T, n, total, filtered int) (*httptest.Server, *int) {
+	t.Helper()
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+		checks := []string{}
+		for id := offset + 1; id <= n && id <= offset+limit; id++ {
+			checks = append(checks, fmt.Sprintf(`{"id":%d,"status":"up"}`, id))
+		}
+		fmt.Fprintf(w, `{"checks":[%s],"counts":{"total":%d,"filtered":%d}}`, strings.Join(checks, ","), total, filtered)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestPingdomChecksPagination(t *testing.T) {
+	tests := []struct {
+		name     string
+		tags     []string
+		n        int
+		total    int
+		filtered int
+		requests int
+	}{
+		{"tags stop on filtered count", []string{"sla"}, 2 * checksPageLimit, 1000, 2 * checksPageLimit, 2},
+		{"tags stop on short page", []string{"sla"}, checksPageLimit + 10, 1000, 0, 2},
+		{"single short page", []string{"sla"}, 3, 1000, 3, 1},
+		{"no tags stop on total", nil, checksPageLimit, checksPageLimit, 0, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := newPaginatedPingdom(t, tt.n, tt.total, tt.filtered)
+			c, err := newTestPingdomClient(srv.URL).getPingdomChecks(context.Background(), tt.tags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(c.Checks) != tt.n {
+				t.Errorf("got %d checks, want %d", len(c.Checks), tt.n)
+			}
+			if *requests != tt.requests {
+				t.Errorf("made %d requests, want %d", *requests, tt.requests)
+			}
+		})
+	}
+}
+
+func TestUpdateRejectsEmptyWindow(t *testing.T) {
+	now := time.Now()
+	equal := &Env{location: time.UTC, windowFrom: ClockTime{hour: 2}, windowTo: ClockTime{hour: 2}}
+	equalFrom, equalTo := maintenanceWindow(equal, now)
+	tests := []struct {
+		name     string
+		from, to int
+		wantErr  bool
+	}{
+		{"from before to", int(now.Unix()), int(now.Unix()) + 1, false},
+		{"from equal to", int(now.Unix()), int(now.Unix()), true},
+		{"from after to", int(now.Unix()) + 1, int(now.Unix()), true},
+		{"WINDOW_FROM equal WINDOW_TO", int(equalFrom.Unix()), int(equalTo.Unix()), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, requests := newFakePingdom(t, http.StatusOK, `{"message":"ok"}`)
+			update := testUpdate()
+			update.From, update.To = tt.from, tt.to
+			err := newTestPingdomClient(srv.URL).updatePingdomMaintenanceSchedule(context.Background(), 11, update)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "invalid maintenance window") {
+					t.Fatalf("got error %v, want an invalid window error", err)
+				}
+				if len(*requests) != 0 {
+					t.Errorf("sent %d requests for an invalid window", len(*requests))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if len(*requests) != 1 {
+				t.Errorf("sent %d requests, want 1", len(*requests))
+			}
+		})
+	}
+}
+
+func TestParsePingdomError(t *testing.T) {
+	tests := []struct {
+		name string
+		code int
+		body string
+		want string
+	}{
+		{"full payload", 403, `{"error":{"statuscode":403,"statusdesc":"Forbidden","errormessage":"Token lacks write access"}}`,
+			"PUT Pingdom maintenance responded with status code: 403 Forbidden: Token lacks write access"},
+		{"status code from the response", 400, `{"error":{"errormessage":"Invalid parameter uptimeids"}}`,
+			"PUT Pingdom maintenance responded with status code: 400: Invalid parameter uptimeids"},
+		{"no errormessage", 500, `{"error":{"statuscode":500,"statusdesc":"Internal Server Error"}}`, ""},
+		{"not json", 502, `<html>Bad Gateway</html>`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perr := parsePingdomError("PUT Pingdom maintenance", tt.code, []byte(tt.body))
+			if tt.want == "" {
+				if perr != nil {
+					t.Fatalf("got %q, want no pingdom error", perr)
+				}
+				return
+			}
+			if perr == nil {
+				t.Fatal("payload not parsed")
+			}
+			if perr.Error() != tt.want {
+				t.Errorf("got %q, want %q", perr.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestPingdomErrorMessagePropagates(t *testing.T) {
+	srv, _ := newFakePingdom(t, http.StatusBadRequest, `{"error":{"statuscode":400,"statusdesc":"Bad Request","errormessage":"Invalid parameter uptimeids"}}`)
+	err := newTestPingdomClient(srv.URL).updatePingdomMaintenanceSchedule(context.Background(), 11, testUpdate())
+	var perr *PingdomError
+	if !errors.As(err, &perr) {
+		t.Fatalf("got %v, want a *PingdomError", err)
+	}
+	if perr.ErrorMessage != "Invalid parameter uptimeids" {
+		t.Errorf("errormessage %q", perr.ErrorMessage)
+	}
+}
+
+func TestRecordCheckStatusTLSVerify(t *testing.T) {
+	recordCheckStatus(PingdomChecks{Checks: []PingdomCheck{
+		{ID: 1, Name: "web", Type: "http", Status: "up", VerifyCertificate: true},
+		{ID: 2, Name: "api", Type: "httpcustom", Status: "up"},
+		{ID: 3, Name: "db", Type: "tcp", Status: "up", VerifyCertificate: true},
+		{ID: 4, Name: "dns", Type: "dns", Status: "up"},
+	}})
+	if got := testutil.CollectAndCount(checkTLSVerify); got != 2 {
+		t.Errorf("tls_verify has %d series, want only the 2 http checks", got)
+	}
+	if got := testutil.ToFloat64(checkTLSVerify.WithLabelValues("1", "web", "")); got != 1 {
+		t.Errorf("tls_verify web %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(checkIPv6); got != 4 {
+		t.Errorf("ipv6 has %d series, want 4", got)
+	}
+}
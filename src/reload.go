@@ -0,0 +1,113 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnvStore ...
+type EnvStore struct {
+	mu  sync.Mutex
+	env *Env
+}
+
+// current configuration
+func (s *EnvStore) get() *Env {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.env
+}
+
+// re-read the api key, poll interval and check tags from the config file,
+// key file and env, the rest of the configuration stays as it was at startup
+func (s *EnvStore) reload() {
+	cfg, err := loadConfig(os.Getenv("CONFIG_FILE"))
+	if err != nil {
+		logError("reload", err, "Reload CONFIG_FILE")
+		return
+	}
+	// a key given as a flag stays fixed
+	apiKey := ""
+	if !flagSet("api-key") {
+		apiKey, err = readAPIKey(getenvDefault("API_KEY", cfg.APIKey), os.Getenv("API_KEY_FILE"))
+		if err != nil {
+			logError("reload", err, "Reload API_KEY_FILE")
+			return
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old := s.env
+	e := *old
+	// a poll interval given as a flag stays fixed
+	if !flagSet("poll-interval") {
+		e.pollInterval = getenvIntDefault("POLL_INTERVAL", cfg.PollInterval)
+		if e.pollInterval == 0 {
+			e.pollInterval = 300
+		}
+	}
+	e.checkTags = splitList(getenvDefault("CHECK_TAGS", strings.Join(cfg.CheckTags, ",")))
+	if len(e.checkTags) == 0 {
+		e.checkTags = []string{"sla"}
+	}
+	// the rate limit delay is capped by the poll interval
+	pingdom := *old.pingdom
+	pingdom.maxRetryDelay = time.Second * time.Duration(e.pollInterval)
+	if apiKey != "" {
+		pingdom.apiKey = apiKey
+	}
+	e.pingdom = &pingdom
+	logInfof("Configuration reloaded")
+	if pingdom.apiKey != old.pingdom.apiKey {
+		logInfof("API key changed")
+	}
+	if e.pollInterval != old.pollInterval {
+		logInfof("Poll Interval: %d -> %d", old.pollInterval, e.pollInterval)
+	}
+	if !compareStrings(e.checkTags, old.checkTags) {
+		logInfof("Tags: %s -> %s", strings.Join(old.checkTags, ","), strings.Join(e.checkTags, ","))
+	}
+	setInfo(&e)
+	s.env = &e
+}
+
+// swap the ids of schedules created by a poll into a copy of the
+// configuration, readers holding the old env never see the ids change
+func (s *EnvStore) replaceCreated(results []ReconcileResult) {
+	created := map[int]int{}
+	for _, r := range results {
+		if r.CreatedID != 0 {
+			created[r.MaintenanceID] = r.CreatedID
+		}
+	}
+	if len(created) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := *s.env
+	e.maintenanceIDs = make([]int, len(s.env.maintenanceIDs))
+	for i, id := range s.env.maintenanceIDs {
+		if newID, ok := created[id]; ok {
+			id = newID
+		}
+		e.maintenanceIDs[i] = id
+	}
+	setInfo(&e)
+	s.env = &e
+}
+
+// compare two []string
+func compareStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i, v := range a {
+		if v != b[i] {
+			return false
+		}
+	}
+	return true
+}
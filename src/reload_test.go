@@ -0,0 +1,33 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestReplaceCreated(t *testing.T) {
+	old := &Env{maintenanceIDs: []int{11, 12, 13}, pollInterval: 300, checkTags: []string{"sla"}}
+	store := &EnvStore{env: old}
+
+	store.replaceCreated([]ReconcileResult{
+		{MaintenanceID: 11, Status: "up_to_date"},
+		{MaintenanceID: 12, Status: "created", CreatedID: 42},
+	})
+
+	if got := store.get().maintenanceIDs; !reflect.DeepEqual(got, []int{11, 42, 13}) {
+		t.Errorf("maintenance ids %v, want [11 42 13]", got)
+	}
+	// a poll still holding the old env must not see the swap
+	if !reflect.DeepEqual(old.maintenanceIDs, []int{11, 12, 13}) {
+		t.Errorf("old env changed to %v", old.maintenanceIDs)
+	}
+}
+
+func TestReplaceCreatedNothingCreated(t *testing.T) {
+	old := &Env{maintenanceIDs: []int{11}}
+	store := &EnvStore{env: old}
+	store.replaceCreated([]ReconcileResult{{MaintenanceID: 11, Status: "updated"}})
+	if store.get() != old {
+		t.Error("env swapped without a created schedule")
+	}
+}
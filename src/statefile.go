@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SavedUpdate ...
+type SavedUpdate struct {
+	Timestamp time.Time                 `json:"timestamp"`
+	Update    MaintenanceScheduleUpdate `json:"update"`
+}
+
+// SavedState ...
+type SavedState struct {
+	mu      sync.Mutex
+	Updates map[int]SavedUpdate `json:"updates"`
+}
+
+var savedState = &SavedState{Updates: map[int]SavedUpdate{}}
+
+// read the state file, a missing file is an empty state
+func loadState(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	savedState.mu.Lock()
+	defer savedState.mu.Unlock()
+	if err := json.Unmarshal(data, savedState); err != nil {
+		return err
+	}
+	if savedState.Updates == nil {
+		savedState.Updates = map[int]SavedUpdate{}
+	}
+	return nil
+}
+
+// seed the check gauges of the configured schedules from the last updates
+// sent so they have values before the first poll, in_sync is left to the
+// first poll to compare
+func seedFromState(ids []int) {
+	savedState.mu.Lock()
+	defer savedState.mu.Unlock()
+	var last time.Time
+	for id, saved := range savedState.Updates {
+		// no series for schedules no longer configured
+		if !containsInt(ids, id) {
+			continue
+		}
+		slaMaintenance.WithLabelValues(strconv.Itoa(id)).Set(float64(len(splitList(saved.Update.Uptimeids))))
+		if saved.Update.Tmsids != nil {
+			tmsMaintenance.WithLabelValues(strconv.Itoa(id)).Set(float64(len(splitList(*saved.Update.Tmsids))))
+		}
+		if saved.Timestamp.After(last) {
+			last = saved.Timestamp
+		}
+		logInfof("Maintenance schedule %d last updated %s", id, saved.Timestamp.Format(time.RFC3339))
+	}
+	if !last.IsZero() {
+		lastUpdate.Set(float64(last.Unix()))
+		state.recordChange(last)
+	}
+}
+
+// record an update sent for a maintenance schedule and write the state file,
+// replacing it atomically so a crash never leaves a partial file
+func saveUpdate(path string, id int, update MaintenanceScheduleUpdate) error {
+	savedState.mu.Lock()
+	defer savedState.mu.Unlock()
+	savedState.Updates[id] = SavedUpdate{Timestamp: time.Now().UTC(), Update: update}
+	data, err := json.MarshalIndent(savedState, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
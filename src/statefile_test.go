@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// reset the saved state shared by the tests
+func resetSavedState(t *testing.T) {
+	t.Helper()
+	savedState = &SavedState{Updates: map[int]SavedUpdate{}}
+	t.Cleanup(func() { savedState = &SavedState{Updates: map[int]SavedUpdate{}} })
+}
+
+func TestSaveUpdateAtomic(t *testing.T) {
+	resetSavedState(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(path, []byte(`{"updates":{}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	update := testUpdate()
+	if err := saveUpdate(path, 11, update); err != nil {
+		t.Fatal(err)
+	}
+	update.Uptimeids = "1,2,3"
+	if err := saveUpdate(path, 12, update); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the state file is left, no temp files
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "state.json" {
+		names := []string{}
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Fatalf("files %v, want only state.json", names)
+	}
+
+	savedState = &SavedState{Updates: map[int]SavedUpdate{}}
+	if err := loadState(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(savedState.Updates) != 2 {
+		t.Fatalf("loaded %d updates, want 2", len(savedState.Updates))
+	}
+	if got := savedState.Updates[12].Update.Uptimeids; got != "1,2,3" {
+		t.Errorf("uptime ids %q, want 1,2,3", got)
+	}
+}
+
+func TestSaveUpdateFailureKeepsFile(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root ignores directory permissions")
+	}
+	resetSavedState(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	if err := saveUpdate(path, 11, testUpdate()); err != nil {
+		t.Fatal(err)
+	}
+	before, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the temp file cannot be created, the old state file is left whole
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(dir, 0755)
+	if err := saveUpdate(path, 12, testUpdate()); err == nil {
+		t.Fatal("expected an error writing to a read-only directory")
+	}
+	after, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Error("state file changed by a failed write")
+	}
+}
+
+func TestLoadStateMissing(t *testing.T) {
+	resetSavedState(t)
+	if err := loadState(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Fatalf("missing state file: %s", err)
+	}
+}
+
+func TestSeedFromState(t *testing.T) {
+	resetSavedState(t)
+	update := testUpdate()
+	savedState.Updates[21] = SavedUpdate{Update: update}
+	savedState.Updates[22] = SavedUpdate{Update: update}
+	inSync.Reset()
+	slaMaintenance.Reset()
+	seedFromState([]int{21})
+	if got := testutil.ToFloat64(slaMaintenance.WithLabelValues("21")); got != 2 {
+		t.Errorf("sla checks %v, want 2", got)
+	}
+	// in sync is only known once a poll has compared
+	if got := testutil.CollectAndCount(inSync); got != 0 {
+		t.Errorf("%d in_sync series, want none before the first poll", got)
+	}
+	// a schedule no longer configured gets no series
+	if got := testutil.CollectAndCount(slaMaintenance); got != 1 {
+		t.Errorf("%d sla checks series, want 1", got)
+	}
+}
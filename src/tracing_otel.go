@@ -0,0 +1,77 @@
+//go:build otel
+// +build otel
+
+package main
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer trace.Tracer = otel.Tracer("ps-pingdom-maintenance")
+
+// start exporting spans over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT is
+// set, the exporter reads the rest of its OTEL_* configuration itself
+func setupTracing() func() {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" {
+		return func() {}
+	}
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		logFatalf("Could not parse env OTEL_EXPORTER_OTLP_ENDPOINT: %s", err)
+	}
+	res := resource.NewSchemaless(
+		attribute.String("service.name", "ps-pingdom-maintenance"),
+		attribute.String("service.version", version),
+	)
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer("ps-pingdom-maintenance")
+	logInfof("Tracing to %s", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	return func() {
+		ctx, done := context.WithTimeout(context.Background(), shutdownGracePeriod)
+		defer done()
+		if err := provider.Shutdown(ctx); err != nil {
+			logError("tracing", err, "Tracing shutdown")
+		}
+	}
+}
+
+// start a span as a child of any span in ctx, ending it records the status
+// code, when there is one, and the error
+func startSpan(ctx context.Context, name string) (context.Context, func(statusCode int, err error)) {
+	ctx, span := tracer.Start(ctx, name)
+	return ctx, func(statusCode int, err error) {
+		if statusCode != 0 {
+			span.SetAttributes(attribute.Int("http.status_code", statusCode))
+		}
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		} else if statusCode >= 400 {
+			span.SetStatus(codes.Error, "")
+		}
+		span.End()
+	}
+}
+
+// trace id of the span in ctx, empty when it is not sampled or tracing is
+// not set up
+func traceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsSampled() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
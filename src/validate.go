@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// fetch the checks and every maintenance schedule once without changing
+// anything, to confirm the api key and maintenance ids before deploying.
+// Returns the errors of the failed requests
+func validateConfig(ctx context.Context, e *Env) []error {
+	errs := []error{}
+	if err := e.resolveName(ctx); err != nil {
+		logError("validate", err, "Pingdom maintenance %q", e.maintenanceName)
+		errs = append(errs, err)
+	}
+	c, err := e.pingdom.getPingdomChecks(ctx, e.checkTags)
+	if err != nil {
+		logError("validate", err, "Pingdom checks")
+		errs = append(errs, err)
+	} else {
+		logInfof("OK checks: %d uptime checks tagged %v", len(c.Checks), e.checkTags)
+	}
+	if e.includeTms {
+		tc, err := e.pingdom.getPingdomTmsChecks(ctx, e.checkTags)
+		if err != nil {
+			logError("validate", err, "Pingdom TMS checks")
+			errs = append(errs, err)
+		} else {
+			logInfof("OK TMS checks: %d transaction checks tagged %v", len(tc.Checks), e.checkTags)
+		}
+	}
+	for _, id := range e.maintenanceIDs {
+		m, err := e.pingdom.getPingdomMainenanceSchedule(ctx, id)
+		if err != nil {
+			logError("validate", err, "Pingdom maintenance %d", id)
+			errs = append(errs, err)
+			continue
+		}
+		logInfof("OK maintenance %d: %q with %d uptime and %d TMS checks", id, m.Maintenance.Description, len(m.Maintenance.Checks.Uptime), len(m.Maintenance.Checks.Tms))
+	}
+	return errs
+}
+
+// true if retrying could not fix any of errs, a rejected key or missing
+// schedule stays that way
+func permanentFailure(errs []error) bool {
+	for _, err := range errs {
+		if errors.Is(err, ErrUnauthorized) || err == errNotFound {
+			return true
+		}
+	}
+	return false
+}
+
+// validate the configuration, retrying up to retries times with a delay
+// doubled on every attempt while the failures look transient
+func validateWithRetries(ctx context.Context, e *Env, retries int, delay time.Duration) error {
+	for attempt := 0; ; attempt++ {
+		errs := validateConfig(ctx, e)
+		if len(errs) == 0 {
+			return nil
+		}
+		err := fmt.Errorf("%d of the Pingdom requests failed", len(errs))
+		if attempt >= retries || permanentFailure(errs) {
+			return err
+		}
+		logWarnf("Config validation failed, retrying in %s (%d/%d): %s", delay, attempt+1, retries, err)
+		if err := sleepContext(ctx, delay); err != nil {
+			return err
+		}
+		delay *= 2
+	}
+}
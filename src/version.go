@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// build metadata, set with -ldflags "-X main.version=..."
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+var buildInfo *prometheus.GaugeVec
+
+// one line description of the build
+func versionString() string {
+	return fmt.Sprintf("ps-pingdom-maintenance %s (commit %s, built %s, %s)", version, commit, buildDate, runtime.Version())
+}
+
+// expose the build metadata
+func setBuildInfo() {
+	buildInfo.WithLabelValues(version, commit, buildDate, runtime.Version()).Set(1)
+}